@@ -1,42 +1,186 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
 	dockernetwork "github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
 	"io"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// ReadContainerLogs parses the container logs provided by the Docker Engine
-func ReadContainerLogs(reader io.Reader, logWriter io.Writer) (err error) {
+// ReadContainerLogs parses the container logs provided by the Docker Engine and separates stdout from stderr
+func ReadContainerLogs(reader io.Reader, stdoutWriter io.Writer, stderrWriter io.Writer) (err error) {
 	header := make([]byte, 8)
+	data := []byte{}
 	for {
-		_, err := reader.Read(header)
+		_, err = io.ReadFull(reader, header)
 		if err != nil {
 			if err == io.EOF {
 				return nil
 			}
-			return Error("Failed to reader log header: %s", err)
+			return Error("Failed to read log header: %s", err)
 		}
+
 		count := binary.BigEndian.Uint32(header[4:])
-		data := make([]byte, count)
-		_, err = reader.Read(data)
+		if uint32(cap(data)) < count {
+			data = make([]byte, count)
+		}
+		data = data[:count]
+		_, err = io.ReadFull(reader, data)
 		if err != nil {
 			return Error("Failed to read log data: %s", err)
 		}
-		logWriter.Write(data)
+
+		if stdcopy.StdType(header[0]) == stdcopy.Stderr {
+			_, err = stderrWriter.Write(data)
+		} else {
+			_, err = stdoutWriter.Write(data)
+		}
+		if err != nil {
+			return Error("Failed to write log data: %s", err)
+		}
 	}
 }
 
+// defaultPullPolicy is used for images without a pull policy
+var defaultPullPolicy = "always"
+
+// SetDefaultPullPolicy sets the pull policy for images without a pull policy
+func SetDefaultPullPolicy(policy string) {
+	defaultPullPolicy = policy
+}
+
+// CheckPullPolicy validates a pull policy
+func CheckPullPolicy(policy string) (err error) {
+	switch policy {
+	case "", "always", "if-not-present", "never":
+	default:
+		err = Error("Pull policy must be always, if-not-present or never (got: %s)", policy)
+	}
+
+	return
+}
+
+// IsImagePresent checks whether an image is available locally
+func IsImagePresent(ctx *context.Context, cli *client.Client, image string) (present bool, err error) {
+	_, _, err = cli.ImageInspectWithRaw(*ctx, image)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, Error("Failed to inspect image <%s>: %s", image, err)
+	}
+
+	return true, nil
+}
+
+// PullImage pulls an image according to the pull policy and waits for the pull to complete
+func PullImage(ctx *context.Context, cli *client.Client, image string, policy string) (err error) {
+	if len(policy) == 0 {
+		policy = defaultPullPolicy
+	}
+
+	// Every image is pulled at most once per build
+	if IsImagePulled(image) {
+		log.Debugf("Image <%s> has already been pulled. Skipping pull.", image)
+		return
+	}
+	defer func() {
+		if err == nil {
+			MarkImagePulled(image)
+		}
+	}()
+
+	if policy != "always" {
+		var present bool
+		present, err = IsImagePresent(ctx, cli, image)
+		if err != nil {
+			return
+		}
+		if present {
+			log.Debugf("Image <%s> is present. Skipping pull.", image)
+			return
+		}
+		if policy == "never" {
+			return Error("Image <%s> is not present and pull policy is never", image)
+		}
+	}
+
+	started := time.Now()
+	_, span := StartSpan(*ctx, "pull", "image", image)
+	defer func() {
+		span.Finish(err)
+		if err == nil {
+			RecordImagePull(image, time.Since(started))
+		}
+	}()
+
+	var encodedAuth string
+	encodedAuth, err = GetRegistryAuth(image)
+	if err != nil {
+		return
+	}
+
+	log.Infof("Pulling image <%s>", image)
+	var pullReader io.ReadCloser
+	pullReader, err = cli.ImagePull(*ctx, image, types.ImagePullOptions{
+		RegistryAuth: encodedAuth,
+	})
+	if err != nil {
+		err = Error("Failed to pull image <%s>: %s", image, err)
+		return
+	}
+	defer pullReader.Close()
+
+	// Display every change of status for each layer
+	layers := map[string]string{}
+	decoder := json.NewDecoder(pullReader)
+	for {
+		var message jsonmessage.JSONMessage
+		err = decoder.Decode(&message)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			err = Error("Failed to read pull messages for image <%s>: %s", image, err)
+			return
+		}
+		if message.Error != nil {
+			err = Error("Failed to pull image <%s>: %s", image, message.Error.Message)
+			return
+		}
+
+		if len(message.ID) == 0 {
+			log.Infof("Pull <%s>: %s", image, message.Status)
+			continue
+		}
+		if layers[message.ID] == message.Status {
+			continue
+		}
+		layers[message.ID] = message.Status
+		if message.Progress != nil && message.Progress.Total > 0 {
+			log.Infof("Pull <%s>: %s %s (%d bytes)", image, message.ID, message.Status, message.Progress.Total)
+		} else {
+			log.Infof("Pull <%s>: %s %s", image, message.ID, message.Status)
+		}
+	}
+
+	return
+}
+
 // MapSSHAgentSocket updates environment variables and bind mounts to map the SSH agent socket into a container
 func MapSSHAgentSocket(environment *[]string, mounts *[]mount.Mount) (err error) {
 	for _, envVar := range os.Environ() {
@@ -60,25 +204,22 @@ func MapSSHAgentSocket(environment *[]string, mounts *[]mount.Mount) (err error)
 	return Error("Unable to environment variable SSH_AUTH_SOCK: %s", "")
 }
 
-// RunForegroundContainer runs a container and waits for it to terminate while streaming the logs before removing the container
-func RunForegroundContainer(ctx *context.Context, cli *client.Client, image string, shell []string, commands []string, user string, environment []string, dir string, network string, volume string, binds []mount.Mount, overrideEntrypoint bool, logWriter io.Writer, files []File) (err error) {
+// RunForegroundContainer runs a container and waits for it to terminate while streaming the logs before removing the container and returns the exit code
+func RunForegroundContainer(ctx *context.Context, cli *client.Client, image string, pull string, shell []string, commands []string, user string, environment []string, dir string, network string, volume string, binds []mount.Mount, overrideEntrypoint bool, timestamps bool, stdoutWriter io.Writer, stderrWriter io.Writer, files []File) (exitCode int64, err error) {
 	failed := false
 
+	spanCtx, span := StartSpan(*ctx, "container", "image", image)
+	defer func() {
+		span.Attributes["exit_code"] = strconv.FormatInt(exitCode, 10)
+		span.Finish(err)
+	}()
+	ctx = &spanCtx
+
 	// pull image
-	var pullReader io.ReadCloser
-	pullReader, err = cli.ImagePull(*ctx, image, types.ImagePullOptions{})
+	err = PullImage(ctx, cli, image, pull)
 	if err != nil {
-		err = Error("Failed to pull image <%s>: %s", image, err)
 		return
 	}
-	scanner := bufio.NewScanner(pullReader)
-	for scanner.Scan() {
-	}
-	if err = scanner.Err(); err != nil {
-		err = Error("Failed to read pull messages for image <%s>: %s", image, err)
-		return
-	}
-	pullReader.Close()
 
 	// create container
 	containerConfig := container.Config{
@@ -97,51 +238,65 @@ func RunForegroundContainer(ctx *context.Context, cli *client.Client, image stri
 	if len(user) > 0 {
 		containerConfig.User = user
 	}
-	mounts := []mount.Mount{
-		{
+	mounts := []mount.Mount{}
+	if len(volume) > 0 {
+		mounts = append(mounts, mount.Mount{
 			Type:   mount.TypeVolume,
 			Source: volume,
 			Target: dir,
-		},
+		})
 	}
 	for _, bind := range binds {
 		mounts = append(mounts, bind)
 	}
+	hostConfig := container.HostConfig{
+		Mounts: mounts,
+	}
 	endpoints := make(map[string]*dockernetwork.EndpointSettings, 1)
 	if len(network) > 0 {
-		endpoints[network] = &dockernetwork.EndpointSettings{}
+		hostConfig.NetworkMode = container.NetworkMode(network)
+		if network != "none" && network != "host" {
+			endpoints[network] = &dockernetwork.EndpointSettings{}
+		}
 	}
+	_, createSpan := StartSpan(*ctx, "create")
 	resp, err := cli.ContainerCreate(
 		*ctx,
 		&containerConfig,
-		&container.HostConfig{
-			Mounts: mounts,
-		},
+		&hostConfig,
 		&dockernetwork.NetworkingConfig{
 			EndpointsConfig: endpoints,
 		},
 		"",
 	)
+	createSpan.Finish(err)
 	if err != nil {
 		err = Error("Failed to create container: %s", err)
 		return
 	}
 	id := resp.ID
+	span.Attributes["container_id"] = id
 
 	// Inject files
-	err = CopyFilesToContainer(ctx, cli, id, files, dir)
-	if err != nil {
-		err = Error("Failed to inject files: %s", err)
-		failed = true
+	if len(files) > 0 {
+		_, copySpan := StartSpan(*ctx, "copy", "direction", "to_container")
+		err = CopyFilesToContainer(ctx, cli, id, files, dir)
+		copySpan.Finish(err)
+		if err != nil {
+			err = Error("Failed to inject files: %s", err)
+			failed = true
+		}
 	}
 
 	// Attach
 	var AttachResp types.HijackedResponse
 	if !failed {
+		_, attachSpan := StartSpan(*ctx, "attach")
 		AttachResp, err = cli.ContainerAttach(*ctx, id, types.ContainerAttachOptions{
 			Stream: true,
 			Stdin:  true,
 		})
+		attachSpan.Finish(err)
 		if err != nil {
 			err = Error("Failed to attach to container: %s", err)
 			failed = true
@@ -151,7 +306,10 @@ func RunForegroundContainer(ctx *context.Context, cli *client.Client, image stri
 
 	// Start container
 	if !failed {
-		if err = cli.ContainerStart(*ctx, id, types.ContainerStartOptions{}); err != nil {
+		_, startSpan := StartSpan(*ctx, "start")
+		err = cli.ContainerStart(*ctx, id, types.ContainerStartOptions{})
+		startSpan.Finish(err)
+		if err != nil {
 			err = Error("Failed to start container: %s", err)
 			failed = true
 		}
@@ -168,24 +326,36 @@ func RunForegroundContainer(ctx *context.Context, cli *client.Client, image stri
 	}
 
 	// Retrieve output
+	logsDone := make(chan struct{})
+	var logsErr error
 	if !failed {
-		reader, err := cli.ContainerLogs(*ctx, id, types.ContainerLogsOptions{
+		var reader io.ReadCloser
+		reader, err = cli.ContainerLogs(*ctx, id, types.ContainerLogsOptions{
 			ShowStdout: true,
 			ShowStderr: true,
 			Follow:     true,
+			Timestamps: timestamps,
 		})
 		if err != nil {
 			err = Error("Failed to connect to container logs: %s", err)
 			failed = true
+			close(logsDone)
 
 		} else {
-			go ReadContainerLogs(reader, logWriter)
+			go func() {
+				defer close(logsDone)
+				defer reader.Close()
+				logsErr = ReadContainerLogs(reader, stdoutWriter, stderrWriter)
+			}()
 		}
+	} else {
+		close(logsDone)
 	}
 
 	// Wait
 	var status container.ContainerWaitOKBody
 	if !failed {
+		_, waitSpan := StartSpan(*ctx, "wait")
 		statusCh, errCh := cli.ContainerWait(*ctx, id, container.WaitConditionNotRunning)
 		select {
 		// Waits for timeout
@@ -193,25 +363,35 @@ func RunForegroundContainer(ctx *context.Context, cli *client.Client, image stri
 			err = Error("Request timed out: %s", (*ctx).Err())
 			failed = true
 		// Waits for error
-		case err := <-errCh:
-			if err != nil {
-				err = Error("Failed to wait for container: %s", err)
+		case waitErr := <-errCh:
+			if waitErr != nil {
+				err = Error("Failed to wait for container: %s", waitErr)
 				failed = true
 			}
 		// Waits for status code
 		case status = <-statusCh:
+			// Drain logs before reporting the container as finished
+			<-logsDone
+			if logsErr != nil {
+				err = Error("Failed to read container logs: %s", logsErr)
+				failed = true
+			}
 		}
+		waitSpan.Finish(err)
 	}
 
 	// Check return code
+	exitCode = status.StatusCode
 	if status.StatusCode > 0 {
 		err = Error("Return code not zero (%s)", strconv.FormatInt(status.StatusCode, 10))
 		failed = true
 	}
 
 	// Extract files
-	if !failed {
+	if !failed && len(files) > 0 {
+		_, copySpan := StartSpan(*ctx, "copy", "direction", "from_container")
 		err = CopyFilesFromContainer(ctx, cli, id, files, dir)
+		copySpan.Finish(err)
 		if err != nil {
 			err = Error("Failed to extract files: %s", err)
 			failed = true
@@ -219,7 +399,15 @@ func RunForegroundContainer(ctx *context.Context, cli *client.Client, image stri
 	}
 
 	// Remove container
-	err2 := cli.ContainerRemove(*ctx, id, types.ContainerRemoveOptions{})
+	removeCtx := *ctx
+	if removeCtx.Err() != nil {
+		removeCtx = context.Background()
+	}
+	_, removeSpan := StartSpan(*ctx, "remove")
+	err2 := cli.ContainerRemove(removeCtx, id, types.ContainerRemoveOptions{
+		Force: true,
+	})
+	removeSpan.Finish(err2)
 	if err2 != nil {
 		err2 = Error("Error: Failed to remove container for image <%s>", image)
 
@@ -229,44 +417,79 @@ func RunForegroundContainer(ctx *context.Context, cli *client.Client, image stri
 		}
 	}
 
+	// Logs end when the container is removed after a failure
+	select {
+	case <-logsDone:
+	case <-removeCtx.Done():
+	}
+
 	return
 }
 
-// RunBackgroundContainer runs a container in the background
-func RunBackgroundContainer(ctx *context.Context, cli *client.Client, image string, environment []string, network string, name string, privileged bool) (id string, err error) {
-	// pull image
-	var pullReader io.ReadCloser
-	pullReader, err = cli.ImagePull(*ctx, image, types.ImagePullOptions{})
+// StreamContainerLogs follows the logs of a container and writes stdout and stderr to separate writers until the container stops
+func StreamContainerLogs(ctx *context.Context, cli *client.Client, id string, stdoutWriter io.Writer, stderrWriter io.Writer) (err error) {
+	var reader io.ReadCloser
+	reader, err = cli.ContainerLogs(*ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
 	if err != nil {
-		err = Error("Failed to pull image <%s>: %s", image, err)
+		err = Error("Failed to connect to container logs: %s", err)
 		return
 	}
-	scanner := bufio.NewScanner(pullReader)
-	for scanner.Scan() {
-	}
-	if err = scanner.Err(); err != nil {
-		err = Error("Failed to read pull messages for image <%s>: %s", image, err)
+	defer reader.Close()
+
+	err = ReadContainerLogs(reader, stdoutWriter, stderrWriter)
+	if err != nil {
+		err = Error("Failed to read container logs: %s", err)
 		return
 	}
-	pullReader.Close()
 
+	return
+}
+
+// RunBackgroundContainer runs a container in the background (the image must have been pulled before)
+func RunBackgroundContainer(ctx *context.Context, cli *client.Client, image string, command []string, entrypoint []string, environment []string, network string, aliases []string, name string, labels map[string]string, privileged bool, ports []string, mounts []mount.Mount, restart string) (id string, err error) {
 	// create container
-	hostConfig := container.HostConfig{}
+	exposedPorts, portBindings, err := nat.ParsePortSpecs(ports)
+	if err != nil {
+		err = Error("Failed to parse ports: %s", err)
+		return
+	}
+	containerConfig := container.Config{
+		Image:        image,
+		Env:          environment,
+		ExposedPorts: exposedPorts,
+		Labels:       labels,
+	}
+	if len(command) > 0 {
+		containerConfig.Cmd = command
+	}
+	if len(entrypoint) > 0 {
+		containerConfig.Entrypoint = entrypoint
+	}
+	hostConfig := container.HostConfig{
+		PortBindings: portBindings,
+		Mounts:       mounts,
+		RestartPolicy: container.RestartPolicy{
+			Name: restart,
+		},
+	}
 	if privileged {
 		log.Warning("Running privileged container.")
 		hostConfig.Privileged = true
 	}
 	endpoints := make(map[string]*dockernetwork.EndpointSettings, 1)
 	if len(network) > 0 {
-		endpoints[network] = &dockernetwork.EndpointSettings{}
+		endpoints[network] = &dockernetwork.EndpointSettings{
+			Aliases: aliases,
+		}
 	}
 	var resp container.ContainerCreateCreatedBody
 	resp, err = cli.ContainerCreate(
 		*ctx,
-		&container.Config{
-			Image: image,
-			Env:   environment,
-		},
+		&containerConfig,
 		&hostConfig,
 		&dockernetwork.NetworkingConfig{
 			EndpointsConfig: endpoints,
@@ -288,41 +511,94 @@ func RunBackgroundContainer(ctx *context.Context, cli *client.Client, image stri
 	return
 }
 
-// StopAndRemoveContainer stops a container, reads the logs and removes it
-func StopAndRemoveContainer(ctx *context.Context, cli *client.Client, id string, logWriter io.Writer) (err error) {
+// StopAndRemoveContainer stops and removes a container
+func StopAndRemoveContainer(ctx *context.Context, cli *client.Client, id string) (err error) {
 	err = cli.ContainerStop(*ctx, id, nil)
 	if err != nil {
 		err = Error("Failed to stop container: %s", err)
 		return
 	}
 
-	Failed := false
-	var reader io.ReadCloser
-	reader, err = cli.ContainerLogs(*ctx, id, types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
+	err = cli.ContainerRemove(*ctx, id, types.ContainerRemoveOptions{})
+	if err != nil {
+		Error("Failed to remove container <%s>: %s", id, err)
+	}
+
+	return nil
+}
+
+// ExecInContainer runs a command in a running container and waits for it to exit
+func ExecInContainer(ctx *context.Context, cli *client.Client, id string, command []string) (exitCode int, err error) {
+	var execResp types.IDResponse
+	execResp, err = cli.ContainerExecCreate(*ctx, id, types.ExecConfig{
+		Cmd: command,
 	})
 	if err != nil {
-		err = Error("Failed to connect to container logs: %s", err)
-		Failed = true
+		err = Error("Failed to create exec in container <%s>: %s", id, err)
+		return
 	}
-	if !Failed && logWriter != nil {
-		err = ReadContainerLogs(reader, logWriter)
+
+	err = cli.ContainerExecStart(*ctx, execResp.ID, types.ExecStartCheck{
+		Detach: true,
+	})
+	if err != nil {
+		err = Error("Failed to start exec in container <%s>: %s", id, err)
+		return
+	}
+
+	for {
+		var inspect types.ContainerExecInspect
+		inspect, err = cli.ContainerExecInspect(*ctx, execResp.ID)
 		if err != nil {
-			err = Error("Failed to read container logs: %s", err)
+			err = Error("Failed to inspect exec in container <%s>: %s", id, err)
+			return
+		}
+		if !inspect.Running {
+			exitCode = inspect.ExitCode
 			return
 		}
+
+		select {
+		case <-(*ctx).Done():
+			err = Error("Request timed out: %s", (*ctx).Err())
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
+}
 
-	err2 := cli.ContainerRemove(*ctx, id, types.ContainerRemoveOptions{})
-	if err2 != nil {
-		err2 = Error("Error: Failed to remove container <%s>", id)
+// GetContainerState returns the state of a container including the result of the healthcheck
+func GetContainerState(ctx *context.Context, cli *client.Client, id string) (state *types.ContainerState, err error) {
+	var inspect types.ContainerJSON
+	inspect, err = cli.ContainerInspect(*ctx, id)
+	if err != nil {
+		err = Error("Failed to inspect container <%s>: %s", id, err)
+		return
+	}
+	state = inspect.State
 
-		if !Failed {
-			err = err2
-			Failed = true
-		}
+	return
+}
+
+// GetContainerLogs reads the logs of a container written so far (tail is a number of lines or "all")
+func GetContainerLogs(ctx *context.Context, cli *client.Client, id string, tail string, logWriter io.Writer) (err error) {
+	var reader io.ReadCloser
+	reader, err = cli.ContainerLogs(*ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       tail,
+	})
+	if err != nil {
+		err = Error("Failed to connect to container logs: %s", err)
+		return
 	}
+	defer reader.Close()
 
-	return nil
+	err = ReadContainerLogs(reader, logWriter, logWriter)
+	if err != nil {
+		err = Error("Failed to read container logs: %s", err)
+		return
+	}
+
+	return
 }
@@ -87,6 +87,58 @@ func InjectFile(ctx *context.Context, cli *client.Client, id string, srcPath str
 	return
 }
 
+// InjectDirectory copies the contents of a local directory into the given subdirectory of the volume while skipping excluded paths
+func InjectDirectory(ctx *context.Context, cli *client.Client, id string, srcPath string, dstPath string, excludes []string, dir string) (err error) {
+	var absPath string
+	absPath, err = filepath.Abs(srcPath)
+	if err != nil {
+		return Error("Failed to obtain absolute path for path <%s>: %s", srcPath, err)
+	}
+
+	var srcStat os.FileInfo
+	srcStat, err = os.Stat(absPath)
+	if err != nil {
+		return Error("Failed to stat source path <%s>: %s", absPath, err)
+	}
+	if !srcStat.IsDir() {
+		return Error("Source path <%s> is not a directory", absPath)
+	}
+
+	srcDir, srcBase := archive.SplitPathDirEntry(absPath)
+	excludePatterns := []string{}
+	for _, exclude := range excludes {
+		if strings.HasPrefix(exclude, "!") {
+			excludePatterns = append(excludePatterns, "!"+srcBase+"/"+exclude[1:])
+		} else {
+			excludePatterns = append(excludePatterns, srcBase+"/"+exclude)
+		}
+	}
+
+	var content io.ReadCloser
+	content, err = archive.TarWithOptions(srcDir, &archive.TarOptions{
+		Compression:      archive.Uncompressed,
+		IncludeFiles:     []string{srcBase},
+		IncludeSourceDir: true,
+		ExcludePatterns:  excludePatterns,
+		RebaseNames: map[string]string{
+			srcBase: dstPath,
+		},
+	})
+	if err != nil {
+		return Error("Failed to create tar archive for path <%s>: %s", absPath, err)
+	}
+	defer content.Close()
+
+	err = cli.CopyToContainer(*ctx, id, dir, content, types.CopyToContainerOptions{
+		AllowOverwriteDirWithFile: false,
+	})
+	if err != nil {
+		return Error("Failed to copy to container for path <%s> (source <%s>): %s", dir, absPath, err)
+	}
+
+	return
+}
+
 // CreateFile creates a new file with the given content in the volume
 func CreateFile(ctx *context.Context, cli *client.Client, id string, name string, data string, dir string) (err error) {
 	var content io.ReadCloser
@@ -126,7 +178,15 @@ func CreateFile(ctx *context.Context, cli *client.Client, id string, name string
 func CopyFilesToContainer(ctx *context.Context, cli *client.Client, id string, files []File, destination string) (err error) {
 	for _, file := range files {
 		if len(file.Inject) > 0 {
-			if len(file.Content) == 0 {
+			if len(file.Content) == 0 && len(file.Destination) > 0 {
+				log.Debugf("Injecting directory <%s> into <%s>", file.Inject, file.Destination)
+				err = InjectDirectory(ctx, cli, id, file.Inject, file.Destination, file.Excludes, destination)
+				if err != nil {
+					err = Error("Failed to inject directory <%s>: %s", file.Inject, err)
+					return
+				}
+
+			} else if len(file.Content) == 0 {
 				var matches []string
 				matches, err = filepath.Glob(file.Inject)
 				if err != nil {
@@ -148,8 +208,13 @@ func CopyFilesToContainer(ctx *context.Context, cli *client.Client, id string, f
 				}
 
 			} else {
-				log.Debugf("Creating file <%s>", file.Inject)
-				err = CreateFile(ctx, cli, id, file.Inject, file.Content, destination)
+				dir := destination
+				if len(file.Destination) > 0 {
+					dir = file.Destination
+				}
+
+				log.Debugf("Creating file <%s> in <%s>", file.Inject, dir)
+				err = CreateFile(ctx, cli, id, file.Inject, file.Content, dir)
 				if err != nil {
 					err = Error("Failed to create file <%s>: %s", file.Inject, err)
 					return
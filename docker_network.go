@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
+	dockernetwork "github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 )
 
@@ -28,11 +29,27 @@ func RemoveNetwork(ctx *context.Context, cli *client.Client, name string) (err e
 }
 
 // CreateNetwork creates a new network
-func CreateNetwork(ctx *context.Context, cli *client.Client, name string, driverName string) (id string, err error) {
+func CreateNetwork(ctx *context.Context, cli *client.Client, name string, driverName string, driverOpts map[string]string, labels map[string]string, subnet string, gateway string, internal bool, enableIPv6 bool) (id string, err error) {
+	options := types.NetworkCreate{
+		Driver:     driverName,
+		Options:    driverOpts,
+		Labels:     labels,
+		Internal:   internal,
+		EnableIPv6: enableIPv6,
+	}
+	if len(subnet) > 0 {
+		options.IPAM = &dockernetwork.IPAM{
+			Config: []dockernetwork.IPAMConfig{
+				{
+					Subnet:  subnet,
+					Gateway: gateway,
+				},
+			},
+		}
+	}
+
 	var network types.NetworkCreateResponse
-	network, err = cli.NetworkCreate(*ctx, name, types.NetworkCreate{
-		Driver: driverName,
-	})
+	network, err = cli.NetworkCreate(*ctx, name, options)
 	if err != nil {
 		err = Error("Failed to create network: %s", err)
 		return
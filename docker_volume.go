@@ -26,10 +26,12 @@ func RemoveVolume(ctx *context.Context, cli *client.Client, name string) (err er
 }
 
 // CreateVolume creates a new volume
-func CreateVolume(ctx *context.Context, cli *client.Client, name string, driverName string) (err error) {
+func CreateVolume(ctx *context.Context, cli *client.Client, name string, driverName string, driverOpts map[string]string, labels map[string]string) (err error) {
 	_, err = cli.VolumeCreate(*ctx, dockervolume.VolumeCreateBody{
-		Name:   name,
-		Driver: driverName,
+		Name:       name,
+		Driver:     driverName,
+		DriverOpts: driverOpts,
+		Labels:     labels,
 	})
 	if err != nil {
 		err = Error("Failed to create volume: %s", err)
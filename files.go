@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
-	"os"
 )
 
 // InjectFiles injects a list of files into the volume
@@ -18,10 +17,16 @@ func InjectFiles(ctx *context.Context, cli *client.Client, files []File, working
 		}
 	}
 
-	err = RunForegroundContainer(
+	stdoutConsoleWriter := NewConsoleOutputWriter("stdout")
+	defer stdoutConsoleWriter.Close()
+	stderrConsoleWriter := NewConsoleOutputWriter("stderr")
+	defer stderrConsoleWriter.Close()
+
+	_, err = RunForegroundContainer(
 		ctx,
 		cli,
 		"alpine",
+		"",
 		[]string{"sh"},
 		[]string{},
 		"",
@@ -31,7 +36,9 @@ func InjectFiles(ctx *context.Context, cli *client.Client, files []File, working
 		volumeName,
 		[]mount.Mount{},
 		false,
-		os.Stdout,
+		false,
+		stdoutConsoleWriter,
+		stderrConsoleWriter,
 		filesToInject,
 	)
 	if err != nil {
@@ -54,10 +61,16 @@ func ExtractFiles(ctx *context.Context, cli *client.Client, files []File, workin
 		}
 	}
 
-	err = RunForegroundContainer(
+	stdoutConsoleWriter := NewConsoleOutputWriter("stdout")
+	defer stdoutConsoleWriter.Close()
+	stderrConsoleWriter := NewConsoleOutputWriter("stderr")
+	defer stderrConsoleWriter.Close()
+
+	_, err = RunForegroundContainer(
 		ctx,
 		cli,
 		"alpine",
+		"",
 		[]string{"sh"},
 		[]string{},
 		"",
@@ -67,7 +80,9 @@ func ExtractFiles(ctx *context.Context, cli *client.Client, files []File, workin
 		volumeName,
 		[]mount.Mount{},
 		false,
-		os.Stdout,
+		false,
+		stdoutConsoleWriter,
+		stderrConsoleWriter,
 		filesToExtract,
 	)
 	if err != nil {
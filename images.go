@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"github.com/docker/docker/client"
+	"sync"
+	"time"
+)
+
+// RequiredImage describes an image used during the build
+type RequiredImage struct {
+	Image string
+	Pull  string
+}
+
+// pulledImages contains the images which have already been pulled or found during the build
+var pulledImages = struct {
+	sync.Mutex
+	images map[string]bool
+}{
+	images: map[string]bool{},
+}
+
+// MarkImagePulled remembers that an image has been pulled or found during the build
+func MarkImagePulled(image string) {
+	pulledImages.Lock()
+	defer pulledImages.Unlock()
+	pulledImages.images[image] = true
+}
+
+// IsImagePulled checks whether an image has already been pulled or found during the build
+func IsImagePulled(image string) bool {
+	pulledImages.Lock()
+	defer pulledImages.Unlock()
+	return pulledImages.images[image]
+}
+
+// GetRequiredImages lists all images used during the build without duplicates
+func GetRequiredImages(build *Build) (images []RequiredImage) {
+	found := map[string]bool{}
+	add := func(image string, pull string) {
+		if len(image) == 0 || found[image] {
+			return
+		}
+		found[image] = true
+		images = append(images, RequiredImage{
+			Image: image,
+			Pull:  pull,
+		})
+	}
+
+	if UsesHelperImage(build) {
+		add("alpine", build.Settings.Pull)
+	}
+	if len(build.Repositories) > 0 {
+		add("alpine/git", build.Settings.Pull)
+	}
+	for _, service := range build.Services {
+		add(service.Image, service.Pull)
+	}
+	for _, step := range build.Steps {
+		add(step.Image, step.Pull)
+	}
+
+	return
+}
+
+// UsesHelperImage checks whether the build requires alpine for files, local repositories, probes, reports or workspace exports
+func UsesHelperImage(build *Build) bool {
+	if len(build.Files) > 0 || build.Settings.ExportOnFailure {
+		return true
+	}
+	for _, repo := range build.Repositories {
+		if IsLocalRepository(repo.Location) {
+			return true
+		}
+	}
+	for _, service := range build.Services {
+		if service.Healthcheck != nil && (service.Healthcheck.TCP > 0 || len(service.Healthcheck.HTTP) > 0) {
+			return true
+		}
+	}
+	for _, step := range build.Steps {
+		if len(step.Reports) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PullImages pulls a list of images in parallel while limiting the number of concurrent pulls
+func PullImages(ctx *context.Context, cli *client.Client, images []RequiredImage, concurrency int, result *BuildResult) (err error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for _, image := range images {
+		wg.Add(1)
+		go func(image RequiredImage) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() {
+				<-slots
+			}()
+
+			started := time.Now()
+			pullErr := PullImage(ctx, cli, image.Image, image.Pull)
+			result.Record("image", image.Image, started, 0, pullErr)
+			if pullErr != nil {
+				mutex.Lock()
+				if err == nil {
+					err = pullErr
+				}
+				mutex.Unlock()
+			}
+		}(image)
+	}
+	wg.Wait()
+
+	return
+}
@@ -2,54 +2,163 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/op/go-logging"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Settings is used to import from YaML
 type Settings struct {
-	VolumeName       string   `yaml:"volume_name"`
-	VolumeDriver     string   `yaml:"volume_driver"`
-	WorkingDirectory string   `yaml:"working_directory"`
-	Shell            []string `yaml:"shell"`
-	NetworkName      string   `yaml:"network_name"`
-	NetworkDriver    string   `yaml:"network_driver"`
-	Timeout          int      `yaml:"timeout"`
-	LogDirectory     string   `yaml:"log_directory"`
-	ConsoleLogLevel  string   `yaml:"console_log_level"`
-	ReuseVolume      bool     `yaml:"reuse_volume"`
-	RetainVolume     bool     `yaml:"retain_volume"`
-	ReuseNetwork     bool     `yaml:"reuse_network"`
-	RetainNetwork    bool     `yaml:"retain_network"`
-	AllowPrivileged  bool
-	AllowDockerSock  bool
+	VolumeName        string            `yaml:"volume_name"`
+	VolumeDriver      string            `yaml:"volume_driver"`
+	VolumeDriverOpts  map[string]string `yaml:"volume_driver_opts"`
+	VolumeLabels      map[string]string `yaml:"volume_labels"`
+	WorkingDirectory  string            `yaml:"working_directory"`
+	Shell             []string          `yaml:"shell"`
+	NetworkName       string            `yaml:"network_name"`
+	NetworkDriver     string            `yaml:"network_driver"`
+	NetworkDriverOpts map[string]string `yaml:"network_driver_opts"`
+	NetworkLabels     map[string]string `yaml:"network_labels"`
+	Subnet            string            `yaml:"subnet"`
+	Gateway           string            `yaml:"gateway"`
+	Internal          bool              `yaml:"internal"`
+	EnableIPv6        bool              `yaml:"enable_ipv6"`
+	Timeout           int               `yaml:"timeout"`
+	LogDirectory      string            `yaml:"log_directory"`
+	ConsoleLogLevel   string            `yaml:"console_log_level"`
+	LogRetention      int               `yaml:"log_retention"`
+	LockTimeout       int               `yaml:"lock_timeout"`
+	LogFormat         string            `yaml:"log_format"`
+	Timestamps        bool              `yaml:"timestamps"`
+	Pull              string            `yaml:"pull"`
+	PullConcurrency   int               `yaml:"pull_concurrency"`
+	ReuseVolume       bool              `yaml:"reuse_volume"`
+	RetainVolume      bool              `yaml:"retain_volume"`
+	ExportOnFailure   bool              `yaml:"export_on_failure"`
+	ReuseNetwork      bool              `yaml:"reuse_network"`
+	RetainNetwork     bool              `yaml:"retain_network"`
+	KnownHosts        KnownHosts        `yaml:"known_hosts"`
+	RegistryAuth      Registries        `yaml:"registry_auth"`
+	AllowPrivileged   bool
+	AllowDockerSock   bool
+	AllowInsecureSSH  bool
+	AllowHostNetwork  bool
+	PullOverride      string
+	BuildID           string
+}
+
+// KnownHosts is either a path to a known_hosts file or a list of inline entries
+type KnownHosts struct {
+	File    string
+	Entries []string
+}
+
+// UnmarshalYAML accepts a string containing a file path or a list of entries
+func (knownHosts *KnownHosts) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	err = unmarshal(&knownHosts.File)
+	if err == nil {
+		return
+	}
+	return unmarshal(&knownHosts.Entries)
+}
+
+// Read returns the entries from the known_hosts file as well as the inline entries
+func (knownHosts KnownHosts) Read() (entries []string, err error) {
+	entries = append(entries, knownHosts.Entries...)
+	if len(knownHosts.File) == 0 {
+		return
+	}
+
+	path := knownHosts.File
+	if strings.HasPrefix(path, "~/") {
+		var home string
+		home, err = os.UserHomeDir()
+		if err != nil {
+			err = Error("Failed to determine home directory: %s", err)
+			return
+		}
+		path = filepath.Join(home, path[2:])
+	}
+
+	var data []byte
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		err = Error("Failed to read known hosts from <%s>: %s", path, err)
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+
+	return
 }
 
 // Repository is used to import from YaML
 type Repository struct {
-	Name             string `yaml:"name"`
-	Location         string `yaml:"location"`
-	Directory        string `yaml:"directory"`
-	Shallow          bool   `yaml:"shallow"`
-	Branch           string `yaml:"branch"`
-	Tag              string `yaml:"tag"`
-	Commit           string `yaml:"commit"`
+	Name             string   `yaml:"name"`
+	Location         string   `yaml:"location"`
+	Directory        string   `yaml:"directory"`
+	Shallow          bool     `yaml:"shallow"`
+	Branch           string   `yaml:"branch"`
+	Tag              string   `yaml:"tag"`
+	Commit           string   `yaml:"commit"`
+	Exclude          []string `yaml:"exclude"`
+	HostKey          string   `yaml:"host_key"`
+	InsecureSSH      bool     `yaml:"insecure_ssh"`
 	WorkingDirectory string
 	VolumeName       string
+	KnownHosts       []string
+	LogDirectory     string
 }
 
 // Service is used to import from YaML
 type Service struct {
-	Name        string   `yaml:"name"`
-	Image       string   `yaml:"image"`
-	Environment []string `yaml:"environment"`
-	SuppressLog bool     `yaml:"suppress_log"`
-	Privileged  bool     `yaml:"privileged"`
-	NetworkName string
+	Name             string       `yaml:"name"`
+	Image            string       `yaml:"image"`
+	Environment      []string     `yaml:"environment"`
+	SuppressLog      bool         `yaml:"suppress_log"`
+	Privileged       bool         `yaml:"privileged"`
+	Healthcheck      *Healthcheck `yaml:"healthcheck"`
+	Command          []string     `yaml:"command"`
+	Entrypoint       []string     `yaml:"entrypoint"`
+	Aliases          []string     `yaml:"aliases"`
+	Ports            []string     `yaml:"ports"`
+	MountVolume      bool         `yaml:"mount_volume"`
+	Restart          string       `yaml:"restart"`
+	DependsOn        []string     `yaml:"depends_on"`
+	Pull             string       `yaml:"pull"`
+	NetworkName      string
+	VolumeName       string
+	WorkingDirectory string
+	LogDirectory     string
+	ContainerName    string
+	Labels           map[string]string
+}
+
+// Healthcheck is used to import from YaML
+type Healthcheck struct {
+	TCP      int      `yaml:"tcp"`
+	HTTP     string   `yaml:"http"`
+	Command  []string `yaml:"command"`
+	Log      string   `yaml:"log"`
+	Docker   bool     `yaml:"docker"`
+	Timeout  int      `yaml:"timeout"`
+	Interval int      `yaml:"interval"`
 }
 
 // File is used to import from YaML
@@ -58,6 +167,7 @@ type File struct {
 	Content     string `yaml:"content"`
 	Extract     string `yaml:"extract"`
 	Destination string
+	Excludes    []string
 }
 
 // Step is used to import from YaML
@@ -72,8 +182,16 @@ type Step struct {
 	MountDockerSock    bool     `yaml:"mount_docker_sock"`
 	ForwardSSHAgent    bool     `yaml:"forward_ssh_agent"`
 	WorkingDirectory   string   `yaml:"working_directory"`
+	StdoutFile         string   `yaml:"stdout_file"`
+	StderrFile         string   `yaml:"stderr_file"`
+	Reports            []string `yaml:"reports"`
+	Pull               string   `yaml:"pull"`
+	Network            string   `yaml:"network"`
 	VolumeName         string
+	Timestamps         bool
 	NetworkName        string
+	LogDirectory       string
+	ReportDirectory    string
 }
 
 // Build is used to import from YaML
@@ -84,21 +202,106 @@ type Build struct {
 	Services     []Service    `yaml:"services"`
 	Environment  []string     `yaml:"environment"`
 	Steps        []Step       `yaml:"steps"`
+	Result       BuildResult  `yaml:"-"`
+}
+
+// RepositoryMetadata contains the resolved state of a repository
+type RepositoryMetadata struct {
+	Name    string `json:"name"`
+	SHA     string `json:"sha"`
+	Ref     string `json:"ref"`
+	Branch  string `json:"branch"`
+	Tag     string `json:"tag"`
+	Message string `json:"message"`
+}
+
+// PhaseResult contains the outcome of a single part of the build
+type PhaseResult struct {
+	Type     string        `json:"type"`
+	Name     string        `json:"name"`
+	Success  bool          `json:"success"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	ExitCode int64         `json:"exit_code"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// BuildResult contains information collected while running the build
+type BuildResult struct {
+	mutex        sync.Mutex
+	Started      time.Time            `json:"started"`
+	Duration     time.Duration        `json:"duration"`
+	Success      bool                 `json:"success"`
+	Repositories []RepositoryMetadata `json:"repositories"`
+	Phases       []PhaseResult        `json:"phases"`
+	Reports      []TestReport         `json:"reports"`
+}
+
+// Record adds the outcome of a part of the build to the result
+func (result *BuildResult) Record(phaseType string, name string, started time.Time, exitCode int64, err error) {
+	phase := PhaseResult{
+		Type:     phaseType,
+		Name:     name,
+		Success:  err == nil,
+		Started:  started,
+		Duration: time.Since(started),
+		ExitCode: exitCode,
+	}
+	if err != nil {
+		phase.Error = err.Error()
+	}
+
+	result.mutex.Lock()
+	defer result.mutex.Unlock()
+	result.Phases = append(result.Phases, phase)
+}
+
+// Start records the start of the build
+func (result *BuildResult) Start(started time.Time) {
+	result.mutex.Lock()
+	defer result.mutex.Unlock()
+	result.Started = started
+}
+
+// Finish records the duration and the outcome of the build
+func (result *BuildResult) Finish(err error) {
+	result.mutex.Lock()
+	defer result.mutex.Unlock()
+	result.Duration = time.Since(result.Started)
+	result.Success = err == nil
+}
+
+// GetPhases returns a copy of the outcome of all parts of the build executed so far
+func (result *BuildResult) GetPhases() []PhaseResult {
+	result.mutex.Lock()
+	defer result.mutex.Unlock()
+	return append([]PhaseResult{}, result.Phases...)
+}
+
+// GetPhase returns the outcome of a part of the build if it was executed
+func (result *BuildResult) GetPhase(phaseType string, name string) (phase PhaseResult, found bool) {
+	for _, phase = range result.GetPhases() {
+		if phase.Type == phaseType && phase.Name == name {
+			return phase, true
+		}
+	}
+	return PhaseResult{}, false
 }
 
 // GetBuildDefinitionDefaults presets defaults values for a build definition
 func GetBuildDefinitionDefaults() *Build {
 	return &Build{
 		Settings: Settings{
-			VolumeName:       "myvolume",
 			VolumeDriver:     "local",
 			WorkingDirectory: "/src",
 			Shell:            []string{"sh"},
 			Timeout:          60 * 60,
-			NetworkName:      "mynetwork",
 			NetworkDriver:    "bridge",
 			LogDirectory:     "logs",
 			ConsoleLogLevel:  "NOTICE",
+			LogFormat:        "text",
+			Pull:             "always",
+			PullConcurrency:  4,
 		},
 	}
 }
@@ -117,7 +320,7 @@ var consoleFormat = logging.MustStringFormatter(
 )
 
 // PrepareLogging create the logging system with file and console backends
-func PrepareLogging(consoleLogLevelString string, fileWriter io.Writer) {
+func PrepareLogging(consoleLogLevelString string, logFormat string, fileWriter io.Writer) {
 	var consoleLogLevel logging.Level
 	switch consoleLogLevelString {
 	case "DEBUG":
@@ -128,14 +331,25 @@ func PrepareLogging(consoleLogLevelString string, fileWriter io.Writer) {
 		consoleLogLevel = logging.INFO
 	}
 
-	fileBackend := logging.NewLogBackend(fileWriter, "", 0)
-	fileBackendFormatter := logging.NewBackendFormatter(fileBackend, fileFormat)
-	fileBackendLeveled := logging.AddModuleLevel(fileBackendFormatter)
-	fileBackendLeveled.SetLevel(logging.INFO, "")
+	logContext.Lock()
+	logContext.format = logFormat
+	logContext.Unlock()
+
+	var fileBackendLeveled, consoleBackendLeveled logging.LeveledBackend
+	if logFormat == "json" {
+		fileBackendLeveled = logging.AddModuleLevel(NewJSONBackend(fileWriter))
+		consoleBackendLeveled = logging.AddModuleLevel(consoleJSONBackend)
 
-	consoleBackend := logging.NewLogBackend(os.Stdout, "", 0)
-	consoleBackendFormatter := logging.NewBackendFormatter(consoleBackend, consoleFormat)
-	consoleBackendLeveled := logging.AddModuleLevel(consoleBackendFormatter)
+	} else {
+		fileBackend := logging.NewLogBackend(fileWriter, "", 0)
+		fileBackendFormatter := logging.NewBackendFormatter(fileBackend, fileFormat)
+		fileBackendLeveled = logging.AddModuleLevel(fileBackendFormatter)
+
+		consoleBackend := logging.NewLogBackend(os.Stdout, "", 0)
+		consoleBackendFormatter := logging.NewBackendFormatter(consoleBackend, consoleFormat)
+		consoleBackendLeveled = logging.AddModuleLevel(consoleBackendFormatter)
+	}
+	fileBackendLeveled.SetLevel(logging.INFO, "")
 	consoleBackendLeveled.SetLevel(consoleLogLevel, "")
 
 	logging.SetBackend(fileBackendLeveled, consoleBackendLeveled)
@@ -143,28 +357,133 @@ func PrepareLogging(consoleLogLevelString string, fileWriter io.Writer) {
 
 // Error logs an error message and returns an error object
 func Error(format string, a ...interface{}) (err error) {
-	message := fmt.Sprintf(format, a)
+	message := fmt.Sprintf(format, a...)
 	log.Error(message)
 	return errors.New(message)
 }
 
+// GetResourceNames fills in volume and network names which were not specified explicitly
+func GetResourceNames(settings *Settings) {
+	if len(settings.VolumeName) == 0 {
+		if settings.ReuseVolume {
+			settings.VolumeName = "myvolume"
+		} else {
+			settings.VolumeName = "insulatr-" + settings.BuildID
+		}
+	}
+	if len(settings.NetworkName) == 0 {
+		if settings.ReuseNetwork {
+			settings.NetworkName = "mynetwork"
+		} else {
+			settings.NetworkName = "insulatr-" + settings.BuildID
+		}
+	}
+}
+
+// GetResourceLabels returns the labels for volumes, networks and service containers created by a build
+func GetResourceLabels(settings Settings, labels map[string]string) map[string]string {
+	resourceLabels := map[string]string{}
+	for name, value := range labels {
+		resourceLabels[name] = value
+	}
+	resourceLabels["insulatr.build_id"] = settings.BuildID
+	return resourceLabels
+}
+
+// NewBuildID creates a unique identifier for a build based on the current time
+func NewBuildID() string {
+	random := make([]byte, 3)
+	rand.Read(random)
+	return fmt.Sprintf("%s-%s", time.Now().Format("20060102-150405"), hex.EncodeToString(random))
+}
+
 // Run executes the build definition
 func Run(buildDefinition *Build) (err error) {
-	if _, err := os.Stat(buildDefinition.Settings.LogDirectory); os.IsNotExist(err) {
-		os.Mkdir(buildDefinition.Settings.LogDirectory, 0755)
+	started := time.Now()
+	buildDefinition.Result.Start(started)
+	defer func() {
+		buildDefinition.Result.Finish(err)
+	}()
+
+	if len(buildDefinition.Settings.BuildID) == 0 {
+		buildDefinition.Settings.BuildID = NewBuildID()
+	}
+
+	GetResourceNames(&buildDefinition.Settings)
+
+	err = PrepareLogDirectory(buildDefinition.Settings)
+	if err != nil {
+		return
 	}
 
-	fileWriter, err := os.OpenFile("logs/test.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	fileWriter, err := os.OpenFile(filepath.Join(GetBuildLogDirectory(buildDefinition.Settings), "build.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		return Error("Failed to open file: ", err)
+		return Error("Failed to open file: %s", err)
 	}
-	PrepareLogging(buildDefinition.Settings.ConsoleLogLevel, fileWriter)
+	defer fileWriter.Close()
+	SetLogBuildID(buildDefinition.Settings.BuildID)
+	PrepareLogging(buildDefinition.Settings.ConsoleLogLevel, buildDefinition.Settings.LogFormat, fileWriter)
 	log.Noticef("Running insulatr version %s built at %s from %s\n", Version, BuildTime, GitCommit)
+	log.Noticef("Build ID: %s", buildDefinition.Settings.BuildID)
+
+	defer func() {
+		err2 := WriteBuildMetadata(buildDefinition, started, err)
+		if err2 != nil {
+			log.Warningf("Unable to write build metadata: %s", err2)
+		}
+	}()
+
+	defer func() {
+		LogBuildSummary(buildDefinition)
+		err2 := WriteBuildSummary(buildDefinition)
+		if err2 != nil {
+			log.Warningf("Unable to write build summary: %s", err2)
+		}
+	}()
+
+	defer func() {
+		LogReportSummary(buildDefinition.Result.Reports)
+	}()
+
+	err = RemoveOldLogDirectories(buildDefinition.Settings, buildDefinition.Settings.LogRetention)
+	if err != nil {
+		log.Warningf("Unable to remove old log directories: %s", err)
+	}
 
 	err = ExpandEnvironment(&buildDefinition.Environment, os.Environ())
 	if err != nil {
 		return Error("Unable to expand global environment: %s", err)
 	}
+	if len(buildDefinition.Settings.PullOverride) > 0 {
+		buildDefinition.Settings.Pull = buildDefinition.Settings.PullOverride
+	}
+	err = CheckPullPolicy(buildDefinition.Settings.Pull)
+	if err != nil {
+		return Error("Invalid pull policy in settings: %s", err)
+	}
+	SetDefaultPullPolicy(buildDefinition.Settings.Pull)
+	err = PrepareRegistryAuth(buildDefinition.Settings.RegistryAuth)
+	if err != nil {
+		return Error("Unable to prepare registry authentication: %s", err)
+	}
+	if len(buildDefinition.Settings.Subnet) > 0 {
+		_, _, err = net.ParseCIDR(buildDefinition.Settings.Subnet)
+		if err != nil {
+			return Error("Invalid subnet <%s>: %s", buildDefinition.Settings.Subnet, err)
+		}
+	}
+	if len(buildDefinition.Settings.Gateway) > 0 {
+		if len(buildDefinition.Settings.Subnet) == 0 {
+			return Error("Gateway <%s> requires a subnet", buildDefinition.Settings.Gateway)
+		}
+		if net.ParseIP(buildDefinition.Settings.Gateway) == nil {
+			return Error("Invalid gateway <%s>", buildDefinition.Settings.Gateway)
+		}
+	}
+	knownHosts, err := buildDefinition.Settings.KnownHosts.Read()
+	if err != nil {
+		return Error("Unable to read known hosts: %s", err)
+	}
 	for index, repo := range buildDefinition.Repositories {
 		log.Debugf("len(buildDefinition.Repositories)=%d.", len(buildDefinition.Repositories))
 		if len(buildDefinition.Repositories) > 1 {
@@ -173,15 +492,73 @@ func Run(buildDefinition *Build) (err error) {
 			}
 		}
 
+		if repo.InsecureSSH && !buildDefinition.Settings.AllowInsecureSSH {
+			return Error("Repository <%s> requests to skip host key verification but AllowInsecureSSH was not specified", repo.Name)
+		}
+
 		buildDefinition.Repositories[index].WorkingDirectory = buildDefinition.Settings.WorkingDirectory
 		buildDefinition.Repositories[index].VolumeName = buildDefinition.Settings.VolumeName
+		buildDefinition.Repositories[index].LogDirectory = filepath.Join(GetBuildLogDirectory(buildDefinition.Settings), "repos")
+		buildDefinition.Repositories[index].KnownHosts = append([]string{}, knownHosts...)
+		if len(repo.HostKey) > 0 {
+			buildDefinition.Repositories[index].KnownHosts = append(buildDefinition.Repositories[index].KnownHosts, repo.HostKey)
+		}
 	}
 	for index, service := range buildDefinition.Services {
 		if service.Privileged && !buildDefinition.Settings.AllowPrivileged {
 			return Error("Service <%s> requests privileged container but AllowPrivileged was not specified", service.Name)
 		}
 
+		err = CheckPullPolicy(service.Pull)
+		if err != nil {
+			return Error("Invalid pull policy for service <%s>: %s", service.Name, err)
+		}
+		if len(service.Pull) == 0 || len(buildDefinition.Settings.PullOverride) > 0 {
+			buildDefinition.Services[index].Pull = buildDefinition.Settings.Pull
+		}
+
 		buildDefinition.Services[index].NetworkName = buildDefinition.Settings.NetworkName
+		buildDefinition.Services[index].VolumeName = buildDefinition.Settings.VolumeName
+		buildDefinition.Services[index].WorkingDirectory = buildDefinition.Settings.WorkingDirectory
+		buildDefinition.Services[index].LogDirectory = filepath.Join(GetBuildLogDirectory(buildDefinition.Settings), "services")
+		buildDefinition.Services[index].ContainerName = "insulatr-" + buildDefinition.Settings.BuildID + "-" + service.Name
+		buildDefinition.Services[index].Labels = GetResourceLabels(buildDefinition.Settings, map[string]string{})
+
+		for _, dependency := range service.DependsOn {
+			found := false
+			for _, other := range buildDefinition.Services {
+				if other.Name == dependency {
+					found = true
+				}
+			}
+			if !found || dependency == service.Name {
+				return Error("Service <%s> depends on unknown service <%s>", service.Name, dependency)
+			}
+		}
+
+		switch service.Restart {
+		case "", "no", "on-failure", "always", "unless-stopped":
+		default:
+			return Error("Service <%s> has invalid restart policy <%s>", service.Name, service.Restart)
+		}
+
+		if service.Healthcheck != nil {
+			if service.Healthcheck.Timeout < 0 || service.Healthcheck.Interval < 0 {
+				return Error("Timeout and interval for healthcheck of service <%s> must not be negative", service.Name)
+			}
+			if service.Healthcheck.Timeout == 0 {
+				service.Healthcheck.Timeout = 60
+			}
+			if service.Healthcheck.Interval == 0 {
+				service.Healthcheck.Interval = 1
+			}
+			if len(service.Healthcheck.Log) > 0 {
+				_, err = regexp.Compile(service.Healthcheck.Log)
+				if err != nil {
+					return Error("Unable to parse log pattern for healthcheck of service <%s>: %s", service.Name, err)
+				}
+			}
+		}
 
 		err = ExpandEnvironment(&service.Environment, buildDefinition.Environment)
 		if err != nil {
@@ -192,11 +569,23 @@ func Run(buildDefinition *Build) (err error) {
 			return Error("Unable to expand environment for service <%s> against process environment: %s", service.Name, err)
 		}
 	}
+	err = CheckServiceDependencies(buildDefinition.Services)
+	if err != nil {
+		return Error("Invalid service dependencies: %s", err)
+	}
 	for index, step := range buildDefinition.Steps {
 		if step.MountDockerSock && !buildDefinition.Settings.AllowDockerSock {
 			return Error("Build step <%s> requests to mount Docker socket but AllowDockerSock was not specified", step.Name)
 		}
 
+		err = CheckPullPolicy(step.Pull)
+		if err != nil {
+			return Error("Invalid pull policy for build step <%s>: %s", step.Name, err)
+		}
+		if len(step.Pull) == 0 || len(buildDefinition.Settings.PullOverride) > 0 {
+			buildDefinition.Steps[index].Pull = buildDefinition.Settings.Pull
+		}
+
 		if len(step.Shell) == 0 {
 			buildDefinition.Steps[index].Shell = buildDefinition.Settings.Shell
 		}
@@ -204,7 +593,27 @@ func Run(buildDefinition *Build) (err error) {
 			buildDefinition.Steps[index].WorkingDirectory = buildDefinition.Settings.WorkingDirectory
 		}
 		buildDefinition.Steps[index].VolumeName = buildDefinition.Settings.VolumeName
-		buildDefinition.Steps[index].NetworkName = buildDefinition.Settings.NetworkName
+		switch step.Network {
+		case "", "build":
+			buildDefinition.Steps[index].NetworkName = buildDefinition.Settings.NetworkName
+		case "host":
+			if !buildDefinition.Settings.AllowHostNetwork {
+				return Error("Build step <%s> requests host network but AllowHostNetwork was not specified", step.Name)
+			}
+			buildDefinition.Steps[index].NetworkName = step.Network
+		default:
+			buildDefinition.Steps[index].NetworkName = step.Network
+		}
+		buildDefinition.Steps[index].Timestamps = buildDefinition.Settings.Timestamps
+		buildDefinition.Steps[index].LogDirectory = filepath.Join(GetBuildLogDirectory(buildDefinition.Settings), "steps")
+		buildDefinition.Steps[index].ReportDirectory = filepath.Join(GetBuildLogDirectory(buildDefinition.Settings), "reports", GetLogFileName(step.Name))
+
+		for _, pattern := range step.Reports {
+			err = CheckReportPattern(pattern)
+			if err != nil {
+				return Error("Invalid report pattern in step <%s>: %s", step.Name, err)
+			}
+		}
 
 		err = MergeEnvironment(buildDefinition.Environment, &step.Environment)
 		if err != nil {
@@ -216,10 +625,47 @@ func Run(buildDefinition *Build) (err error) {
 		}
 	}
 
-	ctx := context.Background()
+	// Volumes and networks with fixed names may be shared with concurrent builds
+	if buildDefinition.Settings.VolumeName != "insulatr-"+buildDefinition.Settings.BuildID {
+		var volumeLock *ResourceLock
+		volumeLock, err = LockResource("volume", buildDefinition.Settings.VolumeName, buildDefinition.Settings.BuildID, buildDefinition.Settings.LockTimeout)
+		if err != nil {
+			return
+		}
+		defer volumeLock.Unlock()
+	}
+	if buildDefinition.Settings.NetworkName != "insulatr-"+buildDefinition.Settings.BuildID {
+		var networkLock *ResourceLock
+		networkLock, err = LockResource("network", buildDefinition.Settings.NetworkName, buildDefinition.Settings.BuildID, buildDefinition.Settings.LockTimeout)
+		if err != nil {
+			return
+		}
+		defer networkLock.Unlock()
+	}
+
+	ctx, buildSpan := StartRemoteSpan(context.Background(), os.Getenv("TRACEPARENT"), "build", "build_id", buildDefinition.Settings.BuildID)
+	defer func() {
+		buildSpan.Finish(err)
+	}()
 	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(buildDefinition.Settings.Timeout)*time.Second)
 	defer cancel()
 
+	// Every phase is traced as a span which ends when the next phase starts
+	ctxPhase := ctxTimeout
+	var phaseSpan *Span
+	startPhase := func(phase string) {
+		if phaseSpan != nil {
+			phaseSpan.Finish(err)
+		}
+		SetLogPhase(phase)
+		ctxPhase, phaseSpan = StartSpan(ctxTimeout, phase)
+	}
+	defer func() {
+		if phaseSpan != nil {
+			phaseSpan.Finish(err)
+		}
+	}()
+
 	cli, err := CreateDockerClient(&ctxTimeout)
 	if err != nil {
 		return Error("Unable to create Docker client: %s", err)
@@ -227,15 +673,27 @@ func Run(buildDefinition *Build) (err error) {
 
 	failedBuild := false
 
+	startPhase("pull")
+	log.Notice("########## Pulling images")
+	err = PullImages(&ctxPhase, cli, GetRequiredImages(buildDefinition), buildDefinition.Settings.PullConcurrency, &buildDefinition.Result)
+	if err != nil {
+		return Error("Failed to pull images: %s", err)
+	}
+
 	if !buildDefinition.Settings.ReuseVolume {
+		startPhase("volume")
+		volumeStarted := time.Now()
 		log.Debug("########## Remove volume")
-		err = RemoveVolume(&ctxTimeout, cli, buildDefinition.Settings.VolumeName)
+		err = RemoveVolume(&ctxPhase, cli, buildDefinition.Settings.VolumeName)
 		if err != nil {
-			return Error("Failed to remove volume: %s", err)
+			err = Error("Failed to remove volume: %s", err)
+			buildDefinition.Result.Record("volume", buildDefinition.Settings.VolumeName, volumeStarted, 0, err)
+			return
 		}
 
 		log.Debug("########## Create volume")
-		err := CreateVolume(&ctxTimeout, cli, buildDefinition.Settings.VolumeName, buildDefinition.Settings.VolumeDriver)
+		err = CreateVolume(&ctxPhase, cli, buildDefinition.Settings.VolumeName, buildDefinition.Settings.VolumeDriver, buildDefinition.Settings.VolumeDriverOpts, GetResourceLabels(buildDefinition.Settings, buildDefinition.Settings.VolumeLabels))
+		buildDefinition.Result.Record("volume", buildDefinition.Settings.VolumeName, volumeStarted, 0, err)
 		if err != nil {
 			return Error("Failed to create volume: %s", err)
 		}
@@ -243,14 +701,31 @@ func Run(buildDefinition *Build) (err error) {
 	}
 
 	if !failedBuild && !buildDefinition.Settings.ReuseNetwork {
+		startPhase("network")
+		networkStarted := time.Now()
 		log.Debug("########## Remove network")
-		err = RemoveNetwork(&ctxTimeout, cli, buildDefinition.Settings.NetworkName)
+		err = RemoveNetwork(&ctxPhase, cli, buildDefinition.Settings.NetworkName)
 		if err != nil {
-			return Error("Failed to remove network: %s", err)
+			err = Error("Failed to remove network: %s", err)
+			buildDefinition.Result.Record("network", buildDefinition.Settings.NetworkName, networkStarted, 0, err)
+			return
 		}
 
 		log.Debug("########## Create network")
-		newNetworkID, err := CreateNetwork(&ctxTimeout, cli, buildDefinition.Settings.NetworkName, buildDefinition.Settings.NetworkDriver)
+		var newNetworkID string
+		newNetworkID, err = CreateNetwork(
+			&ctxPhase,
+			cli,
+			buildDefinition.Settings.NetworkName,
+			buildDefinition.Settings.NetworkDriver,
+			buildDefinition.Settings.NetworkDriverOpts,
+			GetResourceLabels(buildDefinition.Settings, buildDefinition.Settings.NetworkLabels),
+			buildDefinition.Settings.Subnet,
+			buildDefinition.Settings.Gateway,
+			buildDefinition.Settings.Internal,
+			buildDefinition.Settings.EnableIPv6,
+		)
+		buildDefinition.Result.Record("network", buildDefinition.Settings.NetworkName, networkStarted, 0, err)
 		if err != nil {
 			err = Error("Failed to create network: %s", err)
 			failedBuild = true
@@ -258,7 +733,9 @@ func Run(buildDefinition *Build) (err error) {
 		log.Debugf("Network ID: %s", newNetworkID)
 	}
 
+	stepEnvironment := append([]string{}, buildDefinition.Environment...)
 	if !failedBuild && len(buildDefinition.Repositories) > 0 {
+		startPhase("repos")
 		log.Notice("########## Cloning repositories")
 		for index, repo := range buildDefinition.Repositories {
 			if repo.Name == "" {
@@ -270,21 +747,58 @@ func Run(buildDefinition *Build) (err error) {
 			log.Noticef("########## Cloning repository <%s>", repo.Name)
 
 			if repo.Location == "" {
-				err = Error("Repository at index <%d> is missing a location", repo.Name)
+				err = Error("Repository at index <%d> is missing a location", index)
 				failedBuild = true
 				break
 			}
 
-			err = CloneRepo(&ctxTimeout, cli, repo)
+			exists := false
+			if buildDefinition.Settings.ReuseVolume {
+				exists, err = RepoExists(&ctxPhase, cli, repo)
+				if err != nil {
+					failedBuild = true
+					break
+				}
+			}
+
+			if exists {
+				log.Noticef("Repository <%s> already exists in the reused volume. Skipping clone.", repo.Name)
+
+			} else {
+				repoStarted := time.Now()
+				ctxRepo, repoSpan := StartSpan(ctxPhase, "repo", "repo", repo.Name)
+				err = CloneRepo(&ctxRepo, cli, repo)
+				repoSpan.Finish(err)
+				buildDefinition.Result.Record("repo", repo.Name, repoStarted, 0, err)
+				if err != nil {
+					err = Error("Failed to clone repository <%s>: %s", repo.Name, err)
+					failedBuild = true
+					break
+				}
+			}
+
+			var metadata RepositoryMetadata
+			metadata, err = GetRepoMetadata(&ctxPhase, cli, repo)
 			if err != nil {
-				err = Error("Failed to clone repository <%s>: %s", repo.Name, err)
+				if IsLocalRepository(repo.Location) {
+					log.Warningf("Unable to resolve metadata for local repository <%s>. Skipping.", repo.Name)
+					err = nil
+					continue
+				}
+				err = Error("Failed to resolve metadata for repository <%s>: %s", repo.Name, err)
 				failedBuild = true
+				break
 			}
+			log.Noticef("Repository <%s> is at <%s> (%s)", repo.Name, metadata.Ref, metadata.SHA)
+
+			buildDefinition.Result.Repositories = append(buildDefinition.Result.Repositories, metadata)
+			stepEnvironment = append(stepEnvironment, GetRepoEnvironment(metadata)...)
 		}
 	}
 
-	services := make(map[string]string)
+	services := make(map[string]ServiceContainer)
 	if !failedBuild && len(buildDefinition.Services) > 0 {
+		startPhase("services")
 		log.Notice("########## Starting services")
 		for index, service := range buildDefinition.Services {
 			if service.Name == "" {
@@ -292,32 +806,30 @@ func Run(buildDefinition *Build) (err error) {
 				failedBuild = true
 				break
 			}
-
-			log.Noticef("########## Starting service <%s>", service.Name)
-
 			if service.Image == "" {
 				err = Error("Service <%s> is missing an image", service.Name)
 				failedBuild = true
 				break
 			}
+		}
 
-			var containerID string
-			containerID, err = StartService(&ctxTimeout, cli, service, buildDefinition)
+		if !failedBuild {
+			err = StartServices(&ctxPhase, cli, buildDefinition, services)
 			if err != nil {
-				err = Error("Failed to start service <%s>: %s", service.Name, err)
+				err = Error("Failed to start services: %s", err)
 				failedBuild = true
-				break
 			}
-
-			services[service.Name] = containerID
 		}
 	}
 
 	if !failedBuild && len(buildDefinition.Files) > 0 {
+		startPhase("inject")
 		log.Notice("########## Injecting files")
 
 		if !failedBuild {
-			err = InjectFiles(&ctxTimeout, cli, buildDefinition.Files, buildDefinition.Settings.WorkingDirectory, buildDefinition.Settings.VolumeName)
+			injectStarted := time.Now()
+			err = InjectFiles(&ctxPhase, cli, buildDefinition.Files, buildDefinition.Settings.WorkingDirectory, buildDefinition.Settings.VolumeName)
+			buildDefinition.Result.Record("inject", "files", injectStarted, 0, err)
 			if err != nil {
 				err = Error("Failed to inject files: %s", err)
 				failedBuild = true
@@ -326,7 +838,13 @@ func Run(buildDefinition *Build) (err error) {
 	}
 
 	if !failedBuild && len(buildDefinition.Steps) > 0 {
+		startPhase("steps")
 		log.Notice("########## Running build steps")
+
+		ctxSteps, cancelSteps := context.WithCancel(ctxPhase)
+		serviceFailures := make(chan error, 1)
+		stopWatching := WatchServices(&ctxPhase, cli, services, buildDefinition.Services, serviceFailures, cancelSteps)
+
 		for index, step := range buildDefinition.Steps {
 			if step.Name == "" {
 				err = Error("Step at index <%d> is missing a name", index)
@@ -339,6 +857,7 @@ func Run(buildDefinition *Build) (err error) {
 				break
 			}
 
+			SetLogStep(step.Name)
 			log.Noticef("########## running step <%s>", step.Name)
 
 			if len(step.Commands) == 0 {
@@ -347,32 +866,78 @@ func Run(buildDefinition *Build) (err error) {
 				break
 			}
 
-			err = RunStep(&ctxTimeout, cli, step, buildDefinition.Environment)
+			stepStarted := time.Now()
+			var exitCode int64
+			ctxStep, stepSpan := StartSpan(ctxSteps, "step", "step", step.Name)
+			exitCode, err = RunStep(&ctxStep, cli, step, stepEnvironment)
+			stepSpan.Attributes["exit_code"] = strconv.FormatInt(exitCode, 10)
+			stepSpan.Finish(err)
+			buildDefinition.Result.Record("step", step.Name, stepStarted, exitCode, err)
+			if len(step.Reports) > 0 {
+				reports, reportErr := CollectReports(&ctxPhase, cli, step)
+				if reportErr != nil {
+					log.Warningf("Unable to collect reports of step <%s>: %s", step.Name, reportErr)
+				}
+				buildDefinition.Result.Reports = append(buildDefinition.Result.Reports, reports...)
+			}
 			if err != nil {
-				err = Error("Failed to run build step <%s>: %s", step.Name, err)
+				select {
+				case serviceErr := <-serviceFailures:
+					err = Error("Build step <%s> was aborted: %s", step.Name, serviceErr)
+				default:
+					err = Error("Failed to run build step <%s>: %s", step.Name, err)
+				}
 				failedBuild = true
 				break
 			}
 		}
+
+		stopWatching()
+		cancelSteps()
+
+		if !failedBuild {
+			select {
+			case serviceErr := <-serviceFailures:
+				err = Error("Service failed during build steps: %s", serviceErr)
+				failedBuild = true
+			default:
+			}
+		}
 	}
 
 	if !failedBuild && len(buildDefinition.Files) > 0 {
+		startPhase("extract")
 		log.Notice("########## Extracting files")
 
-		err = ExtractFiles(&ctxTimeout, cli, buildDefinition.Files, buildDefinition.Settings.WorkingDirectory, buildDefinition.Settings.VolumeName)
+		extractStarted := time.Now()
+		err = ExtractFiles(&ctxPhase, cli, buildDefinition.Files, buildDefinition.Settings.WorkingDirectory, buildDefinition.Settings.VolumeName)
+		buildDefinition.Result.Record("extract", "files", extractStarted, 0, err)
 		if err != nil {
 			err = Error("Failed to extract files: %s", err)
 			failedBuild = true
 		}
 	}
 
+	if failedBuild && buildDefinition.Settings.ExportOnFailure {
+		startPhase("export")
+		log.Notice("########## Exporting workspace")
+		workspaceFile := filepath.Join(GetBuildLogDirectory(buildDefinition.Settings), "workspace.tar.gz")
+		exportErr := ExportWorkspace(&ctx, cli, buildDefinition.Settings.VolumeName, buildDefinition.Settings.WorkingDirectory, workspaceFile)
+		if exportErr != nil {
+			log.Warningf("Unable to export workspace: %s", exportErr)
+		} else {
+			log.Noticef("Workspace exported to <%s>", workspaceFile)
+		}
+	}
+
+	startPhase("cleanup")
 	if len(services) > 0 {
-		for name, id := range services {
+		for name, serviceContainer := range services {
 			log.Noticef("########## Stopping service %s", name)
 
-			err = StopService(&ctxTimeout, cli, name, id, buildDefinition.Services)
+			err = StopService(&ctxPhase, cli, name, serviceContainer)
 			if err != nil {
-				err = Error("Failed to stop service <%s> with container ID <%s>: %s", name, id, err)
+				err = Error("Failed to stop service <%s> with container ID <%s>: %s", name, serviceContainer.ID, err)
 				failedBuild = true
 				break
 			}
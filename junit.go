@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+)
+
+// JUnitTestSuites is used to export to JUnit XML
+type JUnitTestSuites struct {
+	XMLName    xml.Name         `xml:"testsuites"`
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Skipped    int              `xml:"skipped,attr"`
+	Time       string           `xml:"time,attr"`
+	TestSuites []JUnitTestSuite `xml:"testsuite"`
+}
+
+// JUnitTestSuite is used to export to JUnit XML
+type JUnitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	TestCases []JUnitTestCase `xml:"testcase"`
+}
+
+// JUnitTestCase is used to export to JUnit XML
+type JUnitTestCase struct {
+	Name       string           `xml:"name,attr"`
+	ClassName  string           `xml:"classname,attr"`
+	Time       string           `xml:"time,attr"`
+	Properties *JUnitProperties `xml:"properties,omitempty"`
+	Failure    *JUnitFailure    `xml:"failure,omitempty"`
+	Error      *JUnitFailure    `xml:"error,omitempty"`
+	Skipped    *struct{}        `xml:"skipped,omitempty"`
+	SystemOut  string           `xml:"system-out,omitempty"`
+}
+
+// JUnitProperties is used to export to JUnit XML
+type JUnitProperties struct {
+	Properties []JUnitProperty `xml:"property"`
+}
+
+// JUnitProperty is used to export to JUnit XML
+type JUnitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// JUnitFailure is used to export to JUnit XML
+type JUnitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// NewJUnitTestCase creates a test case from the outcome of a part of the build
+func NewJUnitTestCase(build *Build, phaseType string, name string, logFile string) (testCase JUnitTestCase) {
+	testCase = JUnitTestCase{
+		Name:      name,
+		ClassName: "insulatr." + phaseType,
+		Time:      "0",
+	}
+
+	phase, found := build.Result.GetPhase(phaseType, name)
+	if !found {
+		testCase.Skipped = &struct{}{}
+		return
+	}
+
+	testCase.Time = fmt.Sprintf("%.3f", phase.Duration.Seconds())
+	testCase.Properties = &JUnitProperties{
+		Properties: []JUnitProperty{
+			{
+				Name:  "exit_code",
+				Value: strconv.FormatInt(phase.ExitCode, 10),
+			},
+		},
+	}
+	if !phase.Success {
+		testCase.Failure = &JUnitFailure{
+			Message: phase.Error,
+			Type:    "exit code " + strconv.FormatInt(phase.ExitCode, 10),
+			Text:    phase.Error,
+		}
+	}
+	if len(logFile) > 0 {
+		output, err := ioutil.ReadFile(filepath.Join(GetBuildLogDirectory(build.Settings), logFile))
+		if err == nil {
+			testCase.SystemOut = string(output)
+		}
+	}
+
+	return
+}
+
+// WriteJUnitReport writes the outcome of cloning repositories, starting services and running build steps in JUnit XML format
+func WriteJUnitReport(path string, build *Build) (err error) {
+	testSuites := JUnitTestSuites{
+		Name: build.Settings.BuildID,
+	}
+
+	suites := []struct {
+		phaseType string
+		names     []string
+		logFiles  []string
+	}{
+		{phaseType: "repo"},
+		{phaseType: "service"},
+		{phaseType: "step"},
+	}
+	for _, repo := range build.Repositories {
+		suites[0].names = append(suites[0].names, repo.Name)
+		suites[0].logFiles = append(suites[0].logFiles, filepath.Join("repos", GetLogFileName(repo.Name)+".log"))
+	}
+	for _, service := range build.Services {
+		suites[1].names = append(suites[1].names, service.Name)
+		suites[1].logFiles = append(suites[1].logFiles, filepath.Join("services", GetLogFileName(service.Name)+".log"))
+	}
+	for _, step := range build.Steps {
+		suites[2].names = append(suites[2].names, step.Name)
+		suites[2].logFiles = append(suites[2].logFiles, filepath.Join("steps", GetLogFileName(step.Name)+".log"))
+	}
+
+	var total float64
+	for _, suite := range suites {
+		if len(suite.names) == 0 {
+			continue
+		}
+
+		testSuite := JUnitTestSuite{
+			Name: suite.phaseType,
+		}
+		var suiteTime float64
+		for index, name := range suite.names {
+			testCase := NewJUnitTestCase(build, suite.phaseType, name, suite.logFiles[index])
+			if phase, found := build.Result.GetPhase(suite.phaseType, name); found {
+				suiteTime += phase.Duration.Seconds()
+				if len(testSuite.Timestamp) == 0 {
+					testSuite.Timestamp = phase.Started.Format("2006-01-02T15:04:05")
+				}
+			}
+			if testCase.Failure != nil {
+				testSuite.Failures++
+			}
+			if testCase.Skipped != nil {
+				testSuite.Skipped++
+			}
+			testSuite.Tests++
+			testSuite.TestCases = append(testSuite.TestCases, testCase)
+		}
+		testSuite.Time = fmt.Sprintf("%.3f", suiteTime)
+		total += suiteTime
+
+		testSuites.Tests += testSuite.Tests
+		testSuites.Failures += testSuite.Failures
+		testSuites.Skipped += testSuite.Skipped
+		testSuites.TestSuites = append(testSuites.TestSuites, testSuite)
+	}
+	testSuites.Time = fmt.Sprintf("%.3f", total)
+
+	var data []byte
+	data, err = xml.MarshalIndent(testSuites, "", "  ")
+	if err != nil {
+		return Error("Failed to serialize JUnit report: %s", err)
+	}
+	err = ioutil.WriteFile(path, append([]byte(xml.Header), append(data, '\n')...), 0644)
+	if err != nil {
+		return Error("Failed to write JUnit report to <%s>: %s", path, err)
+	}
+
+	return
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ResourceLock is an advisory lock on a volume or network used by a build
+type ResourceLock struct {
+	file *os.File
+}
+
+// GetLockDirectory returns the directory containing lock files for volumes and networks
+func GetLockDirectory() string {
+	runtimeDirectory := os.Getenv("XDG_RUNTIME_DIR")
+	if len(runtimeDirectory) == 0 {
+		runtimeDirectory = os.TempDir()
+	}
+	return filepath.Join(runtimeDirectory, "insulatr")
+}
+
+// LockResource takes an advisory lock on a volume or network and waits up to the timeout (in seconds) if it is in use by another build
+func LockResource(kind string, name string, buildID string, timeout int) (lock *ResourceLock, err error) {
+	directory := GetLockDirectory()
+	err = os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, Error("Failed to create lock directory <%s>: %s", directory, err)
+	}
+
+	path := filepath.Join(directory, kind+"-"+GetLogFileName(name)+".lock")
+	var file *os.File
+	file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, Error("Failed to open lock file <%s>: %s", path, err)
+	}
+
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	waiting := false
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, Error("Failed to lock %s <%s>: %s", kind, name, err)
+		}
+
+		owner, _ := ioutil.ReadFile(path)
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, Error("The %s <%s> is in use by build <%s>", kind, name, strings.TrimSpace(string(owner)))
+		}
+		if !waiting {
+			log.Noticef("Waiting for %s <%s> which is in use by build <%s>", kind, name, strings.TrimSpace(string(owner)))
+			waiting = true
+		}
+		time.Sleep(time.Second)
+	}
+
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(buildID+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, Error("Failed to write lock file <%s>: %s", path, err)
+	}
+
+	return &ResourceLock{
+		file: file,
+	}, nil
+}
+
+// Unlock releases the lock
+func (lock *ResourceLock) Unlock() {
+	lock.file.Truncate(0)
+	syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+	lock.file.Close()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/op/go-logging"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSONLogEntry is used to export a single log line in JSON format
+type JSONLogEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Level     string    `json:"level"`
+	BuildID   string    `json:"build_id"`
+	Phase     string    `json:"phase,omitempty"`
+	Step      string    `json:"step,omitempty"`
+	Stream    string    `json:"stream,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// logContext contains information added to every log line in JSON format
+var logContext = struct {
+	sync.Mutex
+	format  string
+	buildID string
+	phase   string
+	step    string
+}{
+	format: "text",
+}
+
+// SetLogBuildID sets the build ID for log lines in JSON format
+func SetLogBuildID(buildID string) {
+	logContext.Lock()
+	defer logContext.Unlock()
+	logContext.buildID = buildID
+}
+
+// SetLogPhase sets the current phase of the build for log lines in JSON format
+func SetLogPhase(phase string) {
+	logContext.Lock()
+	defer logContext.Unlock()
+	logContext.phase = phase
+	logContext.step = ""
+}
+
+// SetLogStep sets the current build step for log lines in JSON format
+func SetLogStep(step string) {
+	logContext.Lock()
+	defer logContext.Unlock()
+	logContext.step = step
+}
+
+// NewJSONLogEntry creates a log line containing the current build ID, phase and step
+func NewJSONLogEntry(level string, stream string, message string) JSONLogEntry {
+	logContext.Lock()
+	defer logContext.Unlock()
+	return JSONLogEntry{
+		Timestamp: time.Now(),
+		Level:     level,
+		BuildID:   logContext.buildID,
+		Phase:     logContext.phase,
+		Step:      logContext.step,
+		Stream:    stream,
+		Message:   message,
+	}
+}
+
+// JSONBackend is a logging backend writing one JSON object per line
+type JSONBackend struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// NewJSONBackend creates a logging backend writing one JSON object per line
+func NewJSONBackend(writer io.Writer) *JSONBackend {
+	return &JSONBackend{
+		writer: writer,
+	}
+}
+
+// Log implements the Backend interface of go-logging
+func (backend *JSONBackend) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	entry := NewJSONLogEntry(level.String(), "", strings.TrimRight(record.Message(), "\n"))
+	entry.Timestamp = record.Time
+	return backend.Write(entry)
+}
+
+// Write serializes a log line
+func (backend *JSONBackend) Write(entry JSONLogEntry) (err error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	_, err = backend.writer.Write(append(data, '\n'))
+	return
+}
+
+// consoleJSONBackend writes JSON lines to the console
+var consoleJSONBackend = NewJSONBackend(os.Stdout)
+
+// JSONLineWriter converts output into log lines in JSON format
+type JSONLineWriter struct {
+	backend *JSONBackend
+	stream  string
+	buffer  bytes.Buffer
+}
+
+// Write emits a log line for every complete line and buffers the remainder
+func (writer *JSONLineWriter) Write(data []byte) (n int, err error) {
+	n = len(data)
+	writer.buffer.Write(data)
+	for {
+		line, readErr := writer.buffer.ReadString('\n')
+		if readErr != nil {
+			writer.buffer.WriteString(line)
+			return
+		}
+		err = writer.backend.Write(NewJSONLogEntry("INFO", writer.stream, strings.TrimRight(line, "\r\n")))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Close emits the remaining buffered output
+func (writer *JSONLineWriter) Close() (err error) {
+	if writer.buffer.Len() > 0 {
+		err = writer.backend.Write(NewJSONLogEntry("INFO", writer.stream, writer.buffer.String()))
+		writer.buffer.Reset()
+	}
+	return
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// ColorWriter displays output in color
+type ColorWriter struct {
+	writer io.Writer
+	color  string
+}
+
+// Write surrounds the data with escape sequences to set and reset the color
+func (writer ColorWriter) Write(data []byte) (n int, err error) {
+	_, err = writer.writer.Write([]byte(writer.color + string(data) + "\033[0m"))
+	if err != nil {
+		return
+	}
+	return len(data), nil
+}
+
+// IsTerminal checks whether the file is connected to a terminal
+func IsTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// TaggedLineWriter prefixes every line with the name of the stream
+type TaggedLineWriter struct {
+	mutex  *sync.Mutex
+	writer io.Writer
+	tag    string
+	buffer bytes.Buffer
+}
+
+// NewTaggedLineWriters creates writers for stdout and stderr which share the same underlying writer
+func NewTaggedLineWriters(writer io.Writer) (stdoutWriter *TaggedLineWriter, stderrWriter *TaggedLineWriter) {
+	var mutex sync.Mutex
+	stdoutWriter = &TaggedLineWriter{
+		mutex:  &mutex,
+		writer: writer,
+		tag:    "[stdout] ",
+	}
+	stderrWriter = &TaggedLineWriter{
+		mutex:  &mutex,
+		writer: writer,
+		tag:    "[stderr] ",
+	}
+	return
+}
+
+// Write emits every complete line with the tag and buffers the remainder
+func (writer *TaggedLineWriter) Write(data []byte) (n int, err error) {
+	n = len(data)
+	writer.buffer.Write(data)
+	for {
+		line, readErr := writer.buffer.ReadString('\n')
+		if readErr != nil {
+			writer.buffer.WriteString(line)
+			return
+		}
+		writer.mutex.Lock()
+		_, err = writer.writer.Write([]byte(writer.tag + line))
+		writer.mutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Close emits the remaining buffered output
+func (writer *TaggedLineWriter) Close() (err error) {
+	if writer.buffer.Len() > 0 {
+		writer.mutex.Lock()
+		_, err = writer.writer.Write([]byte(writer.tag + writer.buffer.String() + "\n"))
+		writer.mutex.Unlock()
+		writer.buffer.Reset()
+	}
+	return
+}
+
+// NewConsoleOutputWriter returns a writer for container output displayed on the console
+func NewConsoleOutputWriter(stream string) io.WriteCloser {
+	logContext.Lock()
+	format := logContext.format
+	logContext.Unlock()
+
+	if format == "json" {
+		return &JSONLineWriter{
+			backend: consoleJSONBackend,
+			stream:  stream,
+		}
+	}
+	if stream == "stderr" && IsTerminal(os.Stdout) {
+		return nopWriteCloser{ColorWriter{
+			writer: os.Stdout,
+			color:  "\033[31m",
+		}}
+	}
+	return nopWriteCloser{os.Stdout}
+}
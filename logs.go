@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// BuildMetadata is used to export to metadata.json in the log directory of a build
+type BuildMetadata struct {
+	BuildID      string               `json:"build_id"`
+	Started      time.Time            `json:"started"`
+	Finished     time.Time            `json:"finished"`
+	Success      bool                 `json:"success"`
+	Error        string               `json:"error,omitempty"`
+	Logs         []LogFile            `json:"logs"`
+	Repositories []RepositoryMetadata `json:"repositories"`
+	Reports      []TestReport         `json:"reports,omitempty"`
+}
+
+// LogFile describes a single log file in the log directory of a build
+type LogFile struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Stream string `json:"stream,omitempty"`
+	Path   string `json:"path"`
+}
+
+var logFileNameRegexp = regexp.MustCompile("[^A-Za-z0-9._-]+")
+
+// GetLogFileName converts the name of a step or service into a file name
+func GetLogFileName(name string) string {
+	return logFileNameRegexp.ReplaceAllString(name, "_")
+}
+
+// GetBuildLogDirectory returns the log directory of the current build
+func GetBuildLogDirectory(settings Settings) string {
+	return filepath.Join(settings.LogDirectory, settings.BuildID)
+}
+
+// PrepareLogDirectory creates the log directory of the current build
+func PrepareLogDirectory(settings Settings) (err error) {
+	for _, dir := range []string{"repos", "steps", "services"} {
+		err = os.MkdirAll(filepath.Join(GetBuildLogDirectory(settings), dir), 0755)
+		if err != nil {
+			return Error("Failed to create log directory: %s", err)
+		}
+	}
+
+	return
+}
+
+// RemoveOldLogDirectories removes the log directories of old builds so that only the given number of builds is retained
+func RemoveOldLogDirectories(settings Settings, retain int) (err error) {
+	if retain <= 0 {
+		return
+	}
+
+	var entries []os.FileInfo
+	entries, err = ioutil.ReadDir(settings.LogDirectory)
+	if err != nil {
+		return Error("Failed to read log directory <%s>: %s", settings.LogDirectory, err)
+	}
+
+	// Builds are ranked by metadata.json which is only written when a build has finished so running builds are never removed
+	builds := []os.FileInfo{}
+	finished := map[string]time.Time{}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == settings.BuildID {
+			continue
+		}
+		metadata, err := os.Stat(filepath.Join(settings.LogDirectory, entry.Name(), "metadata.json"))
+		if err != nil {
+			continue
+		}
+		builds = append(builds, entry)
+		finished[entry.Name()] = metadata.ModTime()
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return finished[builds[i].Name()].After(finished[builds[j].Name()])
+	})
+
+	// The current build counts towards the retained builds
+	for index, build := range builds {
+		if index < retain-1 {
+			continue
+		}
+
+		log.Debugf("Removing log directory of build <%s>", build.Name())
+		err = os.RemoveAll(filepath.Join(settings.LogDirectory, build.Name()))
+		if err != nil {
+			return Error("Failed to remove log directory of build <%s>: %s", build.Name(), err)
+		}
+	}
+
+	return
+}
+
+// WriteBuildMetadata writes metadata.json containing an index of all log files of the current build
+func WriteBuildMetadata(build *Build, started time.Time, buildErr error) (err error) {
+	dir := GetBuildLogDirectory(build.Settings)
+
+	metadata := BuildMetadata{
+		BuildID:      build.Settings.BuildID,
+		Started:      started,
+		Finished:     time.Now(),
+		Success:      buildErr == nil,
+		Repositories: build.Result.Repositories,
+		Reports:      build.Result.Reports,
+		Logs: []LogFile{
+			{
+				Type: "build",
+				Name: "build",
+				Path: "build.log",
+			},
+		},
+	}
+	if buildErr != nil {
+		metadata.Error = buildErr.Error()
+	}
+
+	candidates := []LogFile{
+		{
+			Type: "summary",
+			Name: "summary",
+			Path: "summary.md",
+		},
+		{
+			Type: "workspace",
+			Name: "workspace",
+			Path: "workspace.tar.gz",
+		},
+	}
+	for _, repo := range build.Repositories {
+		candidates = append(candidates, LogFile{
+			Type: "repo",
+			Name: repo.Name,
+			Path: filepath.Join("repos", GetLogFileName(repo.Name)+".log"),
+		})
+	}
+	for _, step := range build.Steps {
+		candidates = append(candidates, LogFile{
+			Type: "step",
+			Name: step.Name,
+			Path: filepath.Join("steps", GetLogFileName(step.Name)+".log"),
+		})
+	}
+	for _, service := range build.Services {
+		candidates = append(candidates, LogFile{
+			Type:   "service",
+			Name:   service.Name,
+			Stream: "stdout",
+			Path:   filepath.Join("services", GetLogFileName(service.Name)+".log"),
+		}, LogFile{
+			Type:   "service",
+			Name:   service.Name,
+			Stream: "stderr",
+			Path:   filepath.Join("services", GetLogFileName(service.Name)+".stderr.log"),
+		})
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(filepath.Join(dir, candidate.Path)); err == nil {
+			metadata.Logs = append(metadata.Logs, candidate)
+		}
+	}
+
+	var data []byte
+	data, err = json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return Error("Failed to serialize build metadata: %s", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "metadata.json"), data, 0644)
+	if err != nil {
+		return Error("Failed to write build metadata: %s", err)
+	}
+
+	return
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/mkideal/cli"
 	"gopkg.in/yaml.v2"
@@ -10,17 +11,27 @@ import (
 
 type argT struct {
 	cli.Helper
-	Version     	bool   `cli:"version"             usage:"Show version"                                 dft:"false"`
-	File            string `cli:"f,file"              usage:"Build definition file"                        dft:"./insulatr.yaml"`
-	ReuseVolume     bool   `cli:"reuse-volume"        usage:"Use existing volume"                          dft:"false"`
-	RetainVolume    bool   `cli:"retain-volume"       usage:"Retain volume after build"                    dft:"false"`
-	ReuseNetwork    bool   `cli:"reuse-network"       usage:"Use existing network"                         dft:"false"`
-	RetainNetwork   bool   `cli:"retain-network"      usage:"Retain network after build"                   dft:"false"`
-	Reuse           bool   `cli:"reuse"               usage:"Same as --reuse-volume and --reuse-network"   dft:"false"`
-	Retain          bool   `cli:"retain"              usage:"Same as --retain-volume and --retain-network" dft:"false"`
-	AllowDockerSock bool   `cli:"allow-docker-sock"   usage:"Allow docker socket in build steps"           dft:"false"`
-	AllowPrivileged bool   `cli:"allow-privileged"    usage:"Allow privileged container for services"      dft:"false"`
-	ConsoleLogLevel string `cli:"l,console-log-level" usage:"Controls the log level on the console"`
+	Version          bool   `cli:"version"             usage:"Show version"                                 dft:"false"`
+	File             string `cli:"f,file"              usage:"Build definition file"                        dft:"./insulatr.yaml"`
+	ReuseVolume      bool   `cli:"reuse-volume"        usage:"Use existing volume"                          dft:"false"`
+	RetainVolume     bool   `cli:"retain-volume"       usage:"Retain volume after build"                    dft:"false"`
+	ReuseNetwork     bool   `cli:"reuse-network"       usage:"Use existing network"                         dft:"false"`
+	RetainNetwork    bool   `cli:"retain-network"      usage:"Retain network after build"                   dft:"false"`
+	Reuse            bool   `cli:"reuse"               usage:"Same as --reuse-volume and --reuse-network"   dft:"false"`
+	Retain           bool   `cli:"retain"              usage:"Same as --retain-volume and --retain-network" dft:"false"`
+	AllowDockerSock  bool   `cli:"allow-docker-sock"   usage:"Allow docker socket in build steps"           dft:"false"`
+	AllowPrivileged  bool   `cli:"allow-privileged"    usage:"Allow privileged container for services"      dft:"false"`
+	AllowInsecureSSH bool   `cli:"allow-insecure-ssh"  usage:"Allow skipping SSH host key verification"     dft:"false"`
+	AllowHostNetwork bool   `cli:"allow-host-network"  usage:"Allow host network in build steps"            dft:"false"`
+	ConsoleLogLevel  string `cli:"l,console-log-level" usage:"Controls the log level on the console"`
+	LogFormat        string `cli:"log-format"          usage:"Controls the log format (text or json)"`
+	Timestamps       bool   `cli:"timestamps"          usage:"Prefix output of build steps with timestamps" dft:"false"`
+	Pull             string `cli:"pull"                usage:"Override pull policy (always, if-not-present or never)"`
+	ReportJUnit      string `cli:"report-junit"        usage:"Write JUnit XML report to file"`
+	MetricsFile      string `cli:"metrics-file"        usage:"Write metrics to file in node_exporter textfile format"`
+	MetricsListen    string `cli:"metrics-listen"      usage:"Serve metrics on address during the build"`
+	TraceEndpoint    string `cli:"trace-endpoint"      usage:"Send traces to OTLP/HTTP endpoint"`
+	TraceFile        string `cli:"trace-file"          usage:"Write traces to file in OTLP/JSON format"`
 }
 
 // gitCommit will be filled from build flags
@@ -43,71 +54,246 @@ func main() {
 		Version = "UNKNOWN"
 	}
 
-	os.Exit(cli.Run(new(argT), func(ctx *cli.Context) error {
-		argv := ctx.Argv().(*argT)
+	root := &cli.Command{
+		Name:        os.Args[0],
+		Argv:        func() interface{} { return new(argT) },
+		CanSubRoute: true,
+		Fn:          runBuild,
+	}
+	err := cli.Root(root,
+		cli.Tree(workspaceCommand,
+			cli.Tree(workspaceExportCommand),
+			cli.Tree(workspaceImportCommand),
+		),
+	).Run(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-		if argv.Version {
-			fmt.Fprintf(os.Stdout, "insulatr version %s built at %s from %s\n", Version, BuildTime, GitCommit)
-			os.Exit(0)
-		}
+// runBuild runs the build definition
+func runBuild(ctx *cli.Context) error {
+	argv := ctx.Argv().(*argT)
 
-		_, err := os.Stat(argv.File)
-		if os.IsNotExist(err) {
-			fmt.Fprintf(os.Stderr, "Error: File <%s> does not exist.\n", argv.File)
-			os.Exit(1)
-		}
-		Source, err := ioutil.ReadFile(argv.File)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading file %s: %s\n", argv.File, err)
-			os.Exit(1)
-		}
+	if argv.Version {
+		fmt.Fprintf(os.Stdout, "insulatr version %s built at %s from %s\n", Version, BuildTime, GitCommit)
+		os.Exit(0)
+	}
+
+	_, err := os.Stat(argv.File)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Error: File <%s> does not exist.\n", argv.File)
+		os.Exit(1)
+	}
+	Source, err := ioutil.ReadFile(argv.File)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading file %s: %s\n", argv.File, err)
+		os.Exit(1)
+	}
+
+	buildDefinition := GetBuildDefinitionDefaults()
+	err = yaml.Unmarshal(Source, &buildDefinition)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing YAML: %s\n", err)
+		os.Exit(1)
+	}
+
+	if argv.Reuse {
+		argv.ReuseVolume = true
+		argv.ReuseNetwork = true
+	}
+	if argv.Retain {
+		argv.RetainVolume = true
+		argv.RetainNetwork = true
+	}
+	if argv.ReuseVolume {
+		buildDefinition.Settings.ReuseVolume = argv.ReuseVolume
+	}
+	if argv.RetainVolume {
+		buildDefinition.Settings.RetainVolume = argv.RetainVolume
+	}
+	if argv.ReuseNetwork {
+		buildDefinition.Settings.ReuseNetwork = argv.ReuseNetwork
+	}
+	if argv.RetainNetwork {
+		buildDefinition.Settings.RetainNetwork = argv.RetainNetwork
+	}
+
+	buildDefinition.Settings.AllowPrivileged = argv.AllowPrivileged
+	buildDefinition.Settings.AllowDockerSock = argv.AllowDockerSock
+	buildDefinition.Settings.AllowInsecureSSH = argv.AllowInsecureSSH
+	buildDefinition.Settings.AllowHostNetwork = argv.AllowHostNetwork
+
+	switch argv.ConsoleLogLevel {
+	case "DEBUG", "NOTICE", "INFO":
+		buildDefinition.Settings.ConsoleLogLevel = argv.ConsoleLogLevel
+	case "":
+	default:
+		fmt.Fprintf(os.Stderr, "Console log level must be DEBUG, NOTICE or INFO (got: %s)\n", argv.ConsoleLogLevel)
+		os.Exit(1)
+	}
+
+	if argv.Timestamps {
+		buildDefinition.Settings.Timestamps = argv.Timestamps
+	}
+
+	switch argv.Pull {
+	case "", "always", "if-not-present", "never":
+		buildDefinition.Settings.PullOverride = argv.Pull
+	default:
+		fmt.Fprintf(os.Stderr, "Pull policy must be always, if-not-present or never (got: %s)\n", argv.Pull)
+		os.Exit(1)
+	}
 
-		buildDefinition := GetBuildDefinitionDefaults()
-		err = yaml.Unmarshal(Source, &buildDefinition)
+	if len(argv.LogFormat) > 0 {
+		buildDefinition.Settings.LogFormat = argv.LogFormat
+	}
+	switch buildDefinition.Settings.LogFormat {
+	case "text", "json":
+	default:
+		fmt.Fprintf(os.Stderr, "Log format must be text or json (got: %s)\n", buildDefinition.Settings.LogFormat)
+		os.Exit(1)
+	}
+
+	if len(argv.MetricsListen) > 0 {
+		err = StartMetricsServer(argv.MetricsListen, buildDefinition, argv.File)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing YAML: %s\n", err)
+			fmt.Fprintf(os.Stderr, "Error serving metrics on %s: %s\n", argv.MetricsListen, err)
 			os.Exit(1)
 		}
+	}
 
-		if argv.Reuse {
-			argv.ReuseVolume = true
-			argv.ReuseNetwork = true
+	if len(argv.TraceEndpoint) > 0 || len(argv.TraceFile) > 0 {
+		EnableTracing()
+	}
+
+	err = Run(buildDefinition)
+
+	if len(argv.TraceFile) > 0 {
+		traceErr := WriteTraceFile(argv.TraceFile)
+		if traceErr != nil {
+			fmt.Fprintf(os.Stderr, "Error writing traces to %s: %s\n", argv.TraceFile, traceErr)
 		}
-		if argv.Retain {
-			argv.RetainVolume = true
-			argv.RetainNetwork = true
+	}
+	if len(argv.TraceEndpoint) > 0 {
+		traceErr := SendTraces(argv.TraceEndpoint)
+		if traceErr != nil {
+			fmt.Fprintf(os.Stderr, "Error sending traces to %s: %s\n", argv.TraceEndpoint, traceErr)
 		}
-		if argv.ReuseVolume {
-			buildDefinition.Settings.ReuseVolume = argv.ReuseVolume
+	}
+
+	if len(argv.ReportJUnit) > 0 {
+		reportErr := WriteJUnitReport(argv.ReportJUnit, buildDefinition)
+		if reportErr != nil {
+			fmt.Fprintf(os.Stderr, "Error writing JUnit report to %s: %s\n", argv.ReportJUnit, reportErr)
 		}
-		if argv.RetainVolume {
-			buildDefinition.Settings.RetainVolume = argv.RetainVolume
+	}
+
+	if len(argv.MetricsFile) > 0 {
+		metricsErr := WriteMetricsFile(argv.MetricsFile, buildDefinition, argv.File)
+		if metricsErr != nil {
+			fmt.Fprintf(os.Stderr, "Error writing metrics to %s: %s\n", argv.MetricsFile, metricsErr)
 		}
-		if argv.ReuseNetwork {
-			buildDefinition.Settings.ReuseNetwork = argv.ReuseNetwork
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error building %s: %s\n", argv.File, err)
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+type workspaceExportArgT struct {
+	cli.Helper
+	File   string `cli:"f,file"   usage:"Build definition file"                                 dft:"./insulatr.yaml"`
+	Volume string `cli:"volume"   usage:"Name of the volume (defaults to volume_name or myvolume)"`
+	Output string `cli:"*o,output" usage:"Compressed tarball to write the workspace to"`
+}
+
+type workspaceImportArgT struct {
+	cli.Helper
+	File   string `cli:"f,file" usage:"Build definition file"                                 dft:"./insulatr.yaml"`
+	Volume string `cli:"volume" usage:"Name of the volume (defaults to volume_name or myvolume)"`
+}
+
+var workspaceCommand = &cli.Command{
+	Name: "workspace",
+	Desc: "Export or import the contents of the volume",
+	Fn: func(ctx *cli.Context) error {
+		return fmt.Errorf("Missing subcommand (export or import)")
+	},
+}
+
+var workspaceExportCommand = &cli.Command{
+	Name: "export",
+	Desc: "Write the contents of the volume to a compressed tarball",
+	Argv: func() interface{} { return new(workspaceExportArgT) },
+	Fn: func(ctx *cli.Context) error {
+		argv := ctx.Argv().(*workspaceExportArgT)
+
+		settings, err := GetWorkspaceSettings(argv.File, argv.Volume)
+		if err != nil {
+			return err
 		}
-		if argv.RetainNetwork {
-			buildDefinition.Settings.RetainNetwork = argv.RetainNetwork
+
+		dockerCtx := context.Background()
+		dockerClient, err := CreateDockerClient(&dockerCtx)
+		if err != nil {
+			return err
 		}
 
-		buildDefinition.Settings.AllowPrivileged = argv.AllowPrivileged
-		buildDefinition.Settings.AllowDockerSock = argv.AllowDockerSock
+		return ExportWorkspace(&dockerCtx, dockerClient, settings.VolumeName, settings.WorkingDirectory, argv.Output)
+	},
+}
 
-		switch argv.ConsoleLogLevel {
-		case "DEBUG", "NOTICE", "INFO":
-			buildDefinition.Settings.ConsoleLogLevel = argv.ConsoleLogLevel
-		case "":
-		default:
-			fmt.Fprintf(os.Stderr, "Console log level must be DEBUG, NOTICE or INFO (got: %s)\n", argv.ConsoleLogLevel)
-			os.Exit(1)
+var workspaceImportCommand = &cli.Command{
+	Name:   "import",
+	Desc:   "Extract a compressed tarball into the volume",
+	Text:   "Usage: insulatr workspace import [options] <file>",
+	Argv:   func() interface{} { return new(workspaceImportArgT) },
+	NumArg: cli.ExactN(1),
+	Fn: func(ctx *cli.Context) error {
+		argv := ctx.Argv().(*workspaceImportArgT)
+
+		settings, err := GetWorkspaceSettings(argv.File, argv.Volume)
+		if err != nil {
+			return err
 		}
 
-		err = Run(buildDefinition)
+		dockerCtx := context.Background()
+		dockerClient, err := CreateDockerClient(&dockerCtx)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error building %s: %s\n", argv.File, err)
-			os.Exit(1)
+			return err
+		}
+
+		return ImportWorkspace(&dockerCtx, dockerClient, settings.VolumeName, settings.VolumeDriver, settings.VolumeDriverOpts, settings.VolumeLabels, settings.WorkingDirectory, ctx.Args()[0])
+	},
+}
+
+// GetWorkspaceSettings reads the settings of the build definition (if present) to determine the volume
+func GetWorkspaceSettings(file string, volume string) (settings Settings, err error) {
+	buildDefinition := GetBuildDefinitionDefaults()
+	if _, statErr := os.Stat(file); statErr == nil {
+		var source []byte
+		source, err = ioutil.ReadFile(file)
+		if err != nil {
+			return settings, fmt.Errorf("Error reading file %s: %s", file, err)
+		}
+		err = yaml.Unmarshal(source, &buildDefinition)
+		if err != nil {
+			return settings, fmt.Errorf("Error parsing YAML: %s", err)
 		}
+	}
+
+	settings = buildDefinition.Settings
+	if len(volume) > 0 {
+		settings.VolumeName = volume
+	}
+	if len(settings.VolumeName) == 0 {
+		settings.VolumeName = "myvolume"
+	}
 
-		return nil
-	}))
+	return
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imagePulls contains the time spent pulling images during the build
+var imagePulls = struct {
+	sync.Mutex
+	durations map[string]time.Duration
+}{
+	durations: map[string]time.Duration{},
+}
+
+// RecordImagePull adds the time spent pulling an image
+func RecordImagePull(image string, duration time.Duration) {
+	imagePulls.Lock()
+	defer imagePulls.Unlock()
+	imagePulls.durations[image] += duration
+}
+
+var metricsLabelReplacer = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// MetricsWriter creates metrics in the Prometheus text format
+type MetricsWriter struct {
+	buffer bytes.Buffer
+}
+
+// Describe adds help and type of a metric
+func (writer *MetricsWriter) Describe(name string, help string) {
+	fmt.Fprintf(&writer.buffer, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+// Add adds a sample of a metric with labels given as pairs of name and value
+func (writer *MetricsWriter) Add(name string, value float64, labels ...string) {
+	pairs := []string{}
+	for index := 0; index+1 < len(labels); index += 2 {
+		pairs = append(pairs, labels[index]+"=\""+metricsLabelReplacer.Replace(labels[index+1])+"\"")
+	}
+	fmt.Fprintf(&writer.buffer, "%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// GetMetrics creates metrics describing the current state of the build
+func GetMetrics(build *Build, definition string) []byte {
+	writer := MetricsWriter{}
+
+	build.Result.mutex.Lock()
+	started := build.Result.Started
+	duration := build.Result.Duration
+	success := build.Result.Success
+	build.Result.mutex.Unlock()
+	finished := duration > 0
+	if !finished && !started.IsZero() {
+		duration = time.Since(started)
+	}
+
+	writer.Describe("insulatr_build_start_timestamp_seconds", "Start time of the build")
+	writer.Add("insulatr_build_start_timestamp_seconds", float64(started.Unix()), "definition", definition)
+	writer.Describe("insulatr_build_duration_seconds", "Duration of the build")
+	writer.Add("insulatr_build_duration_seconds", duration.Seconds(), "definition", definition)
+	writer.Describe("insulatr_build_finished", "Whether the build has finished")
+	writer.Add("insulatr_build_finished", boolToFloat(finished), "definition", definition)
+	writer.Describe("insulatr_build_success", "Whether the build was successful")
+	writer.Add("insulatr_build_success", boolToFloat(finished && success), "definition", definition)
+
+	phases := build.Result.GetPhases()
+	metrics := []struct {
+		phaseType string
+		label     string
+		name      string
+		help      string
+	}{
+		{"repo", "repo", "insulatr_repo_clone_duration_seconds", "Time spent cloning a repository"},
+		{"service", "service", "insulatr_service_start_duration_seconds", "Time spent starting a service until it was ready"},
+		{"step", "step", "insulatr_step_duration_seconds", "Duration of a build step"},
+	}
+	for _, metric := range metrics {
+		writer.Describe(metric.name, metric.help)
+		for _, phase := range phases {
+			if phase.Type == metric.phaseType {
+				writer.Add(metric.name, phase.Duration.Seconds(), "definition", definition, metric.label, phase.Name)
+			}
+		}
+	}
+
+	writer.Describe("insulatr_step_exit_code", "Exit code of a build step")
+	for _, phase := range phases {
+		if phase.Type == "step" {
+			writer.Add("insulatr_step_exit_code", float64(phase.ExitCode), "definition", definition, "step", phase.Name)
+		}
+	}
+	writer.Describe("insulatr_step_success", "Whether a build step was successful")
+	for _, phase := range phases {
+		if phase.Type == "step" {
+			writer.Add("insulatr_step_success", boolToFloat(phase.Success), "definition", definition, "step", phase.Name)
+		}
+	}
+
+	imagePulls.Lock()
+	images := []string{}
+	for image := range imagePulls.durations {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	writer.Describe("insulatr_image_pull_duration_seconds", "Time spent pulling an image")
+	for _, image := range images {
+		writer.Add("insulatr_image_pull_duration_seconds", imagePulls.durations[image].Seconds(), "definition", definition, "image", image)
+	}
+	imagePulls.Unlock()
+
+	return writer.buffer.Bytes()
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// WriteMetricsFile writes metrics in the textfile format of node_exporter
+func WriteMetricsFile(path string, build *Build, definition string) (err error) {
+	// Write to a temporary file first so that node_exporter never reads an incomplete file
+	var file *os.File
+	file, err = ioutil.TempFile(filepath.Dir(path), ".insulatr-metrics-")
+	if err != nil {
+		return Error("Failed to create temporary file for metrics: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(GetMetrics(build, definition))
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Error("Failed to write metrics: %s", err)
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return Error("Failed to write metrics to <%s>: %s", path, err)
+	}
+
+	return
+}
+
+// StartMetricsServer serves metrics on /metrics while the build is running
+func StartMetricsServer(address string, build *Build, definition string) (err error) {
+	var listener net.Listener
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		return Error("Failed to listen on <%s>: %s", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		response.Write(GetMetrics(build, definition))
+	})
+	go http.Serve(listener, mux)
+
+	return
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Registries maps registry hosts to credentials
+type Registries map[string]RegistryCredentials
+
+// RegistryCredentials is used to import from YaML
+type RegistryCredentials struct {
+	Username     string `yaml:"username"`
+	PasswordEnv  string `yaml:"password_env"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// Read resolves the password from the environment or from a file
+func (credentials RegistryCredentials) Read() (authConfig types.AuthConfig, err error) {
+	if len(credentials.Username) == 0 {
+		return authConfig, Error("Missing username")
+	}
+	authConfig.Username = credentials.Username
+
+	if len(credentials.PasswordEnv) > 0 {
+		password, found := os.LookupEnv(credentials.PasswordEnv)
+		if !found {
+			return authConfig, Error("Environment variable <%s> is not set", credentials.PasswordEnv)
+		}
+		authConfig.Password = password
+
+	} else if len(credentials.PasswordFile) > 0 {
+		var password []byte
+		password, err = ioutil.ReadFile(credentials.PasswordFile)
+		if err != nil {
+			return authConfig, Error("Failed to read password file <%s>: %s", credentials.PasswordFile, err)
+		}
+		authConfig.Password = strings.TrimRight(string(password), "\r\n")
+
+	} else {
+		return authConfig, Error("Either password_env or password_file is required")
+	}
+
+	return
+}
+
+// registryAuth contains the credentials used to pull images
+var registryAuth = struct {
+	sync.Mutex
+	credentials map[string]types.AuthConfig
+	configFile  *configfile.ConfigFile
+}{
+	credentials: map[string]types.AuthConfig{},
+}
+
+// PrepareRegistryAuth resolves the credentials from the build definition and loads the Docker client configuration
+func PrepareRegistryAuth(registries Registries) (err error) {
+	registryAuth.Lock()
+	defer registryAuth.Unlock()
+
+	for host, credentials := range registries {
+		var authConfig types.AuthConfig
+		authConfig, err = credentials.Read()
+		if err != nil {
+			return Error("Invalid credentials for registry <%s>: %s", host, err)
+		}
+		authConfig.ServerAddress = host
+		registryAuth.credentials[GetRegistryHostname(host)] = authConfig
+	}
+
+	var configFile *configfile.ConfigFile
+	configFile, err = config.Load(config.Dir())
+	if err != nil {
+		log.Warningf("Unable to load Docker client configuration: %s", err)
+		err = nil
+	}
+	registryAuth.configFile = configFile
+
+	return
+}
+
+// GetRegistryHostname normalizes the name of a registry
+func GetRegistryHostname(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		host = "docker.io"
+	}
+	return host
+}
+
+// GetRegistryAuth returns the encoded credentials for the registry of an image
+func GetRegistryAuth(image string) (encodedAuth string, err error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", Error("Failed to parse image name <%s>: %s", image, err)
+	}
+	host := GetRegistryHostname(reference.Domain(named))
+
+	registryAuth.Lock()
+	authConfig, found := registryAuth.credentials[host]
+	configFile := registryAuth.configFile
+	registryAuth.Unlock()
+
+	if !found && configFile != nil {
+		// The Docker client stores credentials for Docker Hub under the URL of the index
+		configHost := host
+		if host == "docker.io" {
+			configHost = "https://index.docker.io/v1/"
+		}
+		clientAuthConfig, err := configFile.GetAuthConfig(configHost)
+		if err != nil {
+			return "", Error("Failed to read credentials for registry <%s>: %s", host, err)
+		}
+		storedAuthConfig := types.AuthConfig(clientAuthConfig)
+		if len(storedAuthConfig.Username) > 0 || len(storedAuthConfig.IdentityToken) > 0 || len(storedAuthConfig.RegistryToken) > 0 {
+			authConfig = storedAuthConfig
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+
+	log.Debugf("Using credentials for registry <%s>", host)
+	var data []byte
+	data, err = json.Marshal(authConfig)
+	if err != nil {
+		return "", Error("Failed to encode credentials for registry <%s>: %s", host, err)
+	}
+
+	return base64.URLEncoding.EncodeToString(data), nil
+}
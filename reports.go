@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// TestReport contains the outcome of a test report collected from a build step
+type TestReport struct {
+	Step        string       `json:"step"`
+	Path        string       `json:"path"`
+	Tests       int          `json:"tests"`
+	Failures    int          `json:"failures"`
+	Skipped     int          `json:"skipped"`
+	FailedTests []FailedTest `json:"failed_tests,omitempty"`
+}
+
+// FailedTest describes a single failing test case in a test report
+type FailedTest struct {
+	Suite     string `json:"suite"`
+	ClassName string `json:"classname"`
+	Name      string `json:"name"`
+	Message   string `json:"message"`
+}
+
+// CheckReportPattern makes sure that a report pattern stays inside the volume
+func CheckReportPattern(pattern string) (err error) {
+	if len(pattern) == 0 || path.IsAbs(pattern) {
+		return Error("Report pattern <%s> must be a relative path", pattern)
+	}
+	for _, element := range strings.Split(pattern, "/") {
+		if element == ".." {
+			return Error("Report pattern <%s> must not leave the working directory", pattern)
+		}
+	}
+
+	return
+}
+
+// FindReports lists the files in the volume matching the report patterns of a step
+func FindReports(ctx *context.Context, cli *client.Client, step Step) (matches []string, err error) {
+	commands := []string{}
+	for _, pattern := range step.Reports {
+		commands = append(commands, "for f in "+pattern+"; do if [ -f \"$f\" ]; then echo \"$f\"; fi; done")
+	}
+
+	stderrConsoleWriter := NewConsoleOutputWriter("stderr")
+	defer stderrConsoleWriter.Close()
+
+	var output bytes.Buffer
+	_, err = RunForegroundContainer(
+		ctx,
+		cli,
+		"alpine",
+		"",
+		[]string{"sh"},
+		commands,
+		"",
+		[]string{},
+		step.WorkingDirectory,
+		"",
+		step.VolumeName,
+		[]mount.Mount{},
+		true,
+		false,
+		&output,
+		stderrConsoleWriter,
+		[]File{},
+	)
+	if err != nil {
+		err = Error("Failed to search for reports: %s", err)
+		return
+	}
+
+	found := map[string]bool{}
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		match := strings.TrimPrefix(scanner.Text(), "./")
+		if len(match) == 0 || found[match] || CheckReportPattern(match) != nil {
+			continue
+		}
+		found[match] = true
+		matches = append(matches, match)
+	}
+
+	return
+}
+
+// CollectReports copies the test reports of a step from the volume and parses them
+func CollectReports(ctx *context.Context, cli *client.Client, step Step) (reports []TestReport, err error) {
+	var matches []string
+	matches, err = FindReports(ctx, cli, step)
+	if err != nil {
+		return
+	}
+	if len(matches) == 0 {
+		log.Warningf("No reports found for step <%s>", step.Name)
+		return
+	}
+
+	files := []File{}
+	for _, match := range matches {
+		destination := filepath.Join(step.ReportDirectory, filepath.FromSlash(path.Dir(match)))
+		err = os.MkdirAll(destination, 0755)
+		if err != nil {
+			err = Error("Failed to create report directory <%s>: %s", destination, err)
+			return
+		}
+		files = append(files, File{
+			Extract:     match,
+			Destination: destination + string(filepath.Separator),
+		})
+	}
+
+	stdoutConsoleWriter := NewConsoleOutputWriter("stdout")
+	defer stdoutConsoleWriter.Close()
+	stderrConsoleWriter := NewConsoleOutputWriter("stderr")
+	defer stderrConsoleWriter.Close()
+
+	_, err = RunForegroundContainer(
+		ctx,
+		cli,
+		"alpine",
+		"",
+		[]string{"sh"},
+		[]string{},
+		"",
+		[]string{},
+		step.WorkingDirectory,
+		"",
+		step.VolumeName,
+		[]mount.Mount{},
+		false,
+		false,
+		stdoutConsoleWriter,
+		stderrConsoleWriter,
+		files,
+	)
+	if err != nil {
+		err = Error("Failed to extract reports: %s", err)
+		return
+	}
+
+	for _, match := range matches {
+		log.Debugf("Parsing report <%s> of step <%s>", match, step.Name)
+		report, err := ParseJUnitReport(filepath.Join(step.ReportDirectory, filepath.FromSlash(match)))
+		if err != nil {
+			log.Warningf("Unable to parse report <%s> of step <%s>: %s", match, step.Name, err)
+			continue
+		}
+		report.Step = step.Name
+		report.Path = match
+		reports = append(reports, report)
+	}
+
+	return
+}
+
+// ParseJUnitReport reads a test report in JUnit XML format
+func ParseJUnitReport(path string) (report TestReport, err error) {
+	var data []byte
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var testSuites JUnitTestSuites
+	err = xml.Unmarshal(data, &testSuites)
+	if err != nil {
+		var testSuite JUnitTestSuite
+		err = xml.Unmarshal(data, &testSuite)
+		if err != nil {
+			return
+		}
+		testSuites.TestSuites = []JUnitTestSuite{testSuite}
+	}
+
+	for _, testSuite := range testSuites.TestSuites {
+		for _, testCase := range testSuite.TestCases {
+			report.Tests++
+			if testCase.Skipped != nil {
+				report.Skipped++
+			}
+
+			failure := testCase.Failure
+			if failure == nil {
+				failure = testCase.Error
+			}
+			if failure == nil {
+				continue
+			}
+
+			report.Failures++
+			message := failure.Message
+			if len(message) == 0 {
+				message = strings.TrimSpace(failure.Text)
+			}
+			if index := strings.Index(message, "\n"); index >= 0 {
+				message = message[:index]
+			}
+			report.FailedTests = append(report.FailedTests, FailedTest{
+				Suite:     testSuite.Name,
+				ClassName: testCase.ClassName,
+				Name:      testCase.Name,
+				Message:   message,
+			})
+		}
+	}
+
+	return
+}
+
+// LogReportSummary displays the failing tests found in the reports of all steps
+func LogReportSummary(reports []TestReport) {
+	if len(reports) == 0 {
+		return
+	}
+
+	tests, failures, skipped := 0, 0, 0
+	for _, report := range reports {
+		tests += report.Tests
+		failures += report.Failures
+		skipped += report.Skipped
+	}
+
+	log.Notice("########## Test reports")
+	log.Noticef("%d tests, %d failed, %d skipped in %d reports", tests, failures, skipped, len(reports))
+	for _, report := range reports {
+		for _, test := range report.FailedTests {
+			name := test.Name
+			if len(test.ClassName) > 0 {
+				name = test.ClassName + "." + test.Name
+			}
+			log.Errorf("FAILED %s (step <%s>, report <%s>): %s", name, report.Step, report.Path, test.Message)
+		}
+	}
+}
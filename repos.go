@@ -1,14 +1,179 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 )
 
+// IsLocalRepository checks whether the location of a repository refers to a local path
+func IsLocalRepository(location string) bool {
+	return location == "." ||
+		location == ".." ||
+		strings.HasPrefix(location, "/") ||
+		strings.HasPrefix(location, "./") ||
+		strings.HasPrefix(location, "../")
+}
+
+// ConvertIgnorePattern translates a pattern from .gitignore into an exclude pattern for the tar archive
+func ConvertIgnorePattern(pattern string) string {
+	negated := strings.HasPrefix(pattern, "!")
+	if negated {
+		pattern = pattern[1:]
+	}
+
+	pattern = strings.TrimSuffix(pattern, "/")
+	if strings.HasPrefix(pattern, "/") {
+		pattern = pattern[1:]
+	} else if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+
+	if negated {
+		pattern = "!" + pattern
+	}
+	return pattern
+}
+
+// ReadIgnoreFile reads the patterns from a .gitignore file
+func ReadIgnoreFile(path string) (patterns []string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		err = Error("Failed to open ignore file <%s>: %s", path, err)
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, ConvertIgnorePattern(line))
+	}
+	if err = scanner.Err(); err != nil {
+		err = Error("Failed to read ignore file <%s>: %s", path, err)
+		return
+	}
+
+	return
+}
+
+// GetRepoDirectory returns the directory inside the working directory which contains the repository
+func GetRepoDirectory(repo Repository) (directory string, err error) {
+	if len(repo.Directory) > 0 {
+		return repo.Directory, nil
+	}
+
+	if IsLocalRepository(repo.Location) {
+		var absPath string
+		absPath, err = filepath.Abs(repo.Location)
+		if err != nil {
+			err = Error("Failed to obtain absolute path for repository <%s>: %s", repo.Name, err)
+			return
+		}
+		return filepath.Base(absPath), nil
+	}
+
+	location := strings.TrimSuffix(repo.Location, "/")
+	if pos := strings.LastIndex(location, ":"); pos > -1 && !strings.Contains(location, "://") {
+		location = location[pos+1:]
+	}
+	return strings.TrimSuffix(path.Base(location), ".git"), nil
+}
+
+// CopyRepo copies a local working tree including uncommitted changes into the volume
+func CopyRepo(ctx *context.Context, cli *client.Client, repo Repository, stdoutWriter io.Writer, stderrWriter io.Writer) (err error) {
+	if len(repo.Branch) > 0 || len(repo.Tag) > 0 || len(repo.Commit) > 0 || repo.Shallow {
+		log.Warningf("Ignoring shallow, branch, tag and commit for local repository <%s>.", repo.Name)
+	}
+
+	var directory string
+	directory, err = GetRepoDirectory(repo)
+	if err != nil {
+		return
+	}
+
+	var excludes []string
+	excludes, err = ReadIgnoreFile(filepath.Join(repo.Location, ".gitignore"))
+	if err != nil {
+		err = Error("Failed to read .gitignore for repository <%s>: %s", repo.Name, err)
+		return
+	}
+	for _, exclude := range repo.Exclude {
+		excludes = append(excludes, ConvertIgnorePattern(exclude))
+	}
+
+	_, err = RunForegroundContainer(
+		ctx,
+		cli,
+		"alpine",
+		"",
+		[]string{"sh"},
+		[]string{},
+		"",
+		[]string{},
+		repo.WorkingDirectory,
+		"",
+		repo.VolumeName,
+		[]mount.Mount{},
+		false,
+		false,
+		stdoutWriter,
+		stderrWriter,
+		[]File{
+			{
+				Inject:      repo.Location,
+				Destination: directory,
+				Excludes:    excludes,
+			},
+		},
+	)
+	if err != nil {
+		err = Error("Failed to copy repository <%s>: %s", repo.Name, err)
+		return
+	}
+
+	return
+}
+
 // CloneRepo clones a list of repositories into the volume
 func CloneRepo(ctx *context.Context, cli *client.Client, repo Repository) (err error) {
+	var logFile *os.File
+	logFile, err = os.Create(filepath.Join(repo.LogDirectory, GetLogFileName(repo.Name)+".log"))
+	if err != nil {
+		err = Error("Failed to create log file for repository <%s>: %s", repo.Name, err)
+		return
+	}
+	defer logFile.Close()
+	stdoutLogWriter, stderrLogWriter := NewTaggedLineWriters(logFile)
+	defer stdoutLogWriter.Close()
+	defer stderrLogWriter.Close()
+
+	stdoutConsoleWriter := NewConsoleOutputWriter("stdout")
+	defer stdoutConsoleWriter.Close()
+	stderrConsoleWriter := NewConsoleOutputWriter("stderr")
+	defer stderrConsoleWriter.Close()
+
+	stdoutWriter := io.MultiWriter(stdoutConsoleWriter, stdoutLogWriter)
+	stderrWriter := io.MultiWriter(stderrConsoleWriter, stderrLogWriter)
+
+	if IsLocalRepository(repo.Location) {
+		return CopyRepo(ctx, cli, repo, stdoutWriter, stderrWriter)
+	}
+
 	var ref string
 	if len(repo.Branch) > 0 {
 		ref = repo.Branch
@@ -35,8 +200,22 @@ func CloneRepo(ctx *context.Context, cli *client.Client, repo Repository) (err e
 
 	environment := []string{}
 	bindMounts := []mount.Mount{}
-	if len(os.Getenv("SSH_AUTH_SOCK")) > 0 {
+	files := []File{}
+	if repo.InsecureSSH {
+		log.Warningf("Skipping host key verification for repo <%s>.", repo.Name)
 		environment = append(environment, "GIT_SSH_COMMAND=ssh -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no")
+
+	} else {
+		environment = append(environment, "GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=yes")
+		if len(repo.KnownHosts) > 0 {
+			files = append(files, File{
+				Inject:      "ssh_known_hosts",
+				Content:     strings.Join(repo.KnownHosts, "\n") + "\n",
+				Destination: "/etc/ssh",
+			})
+		}
+	}
+	if len(os.Getenv("SSH_AUTH_SOCK")) > 0 {
 		err = MapSSHAgentSocket(&environment, &bindMounts)
 		if err != nil {
 			err = Error("Unable to map SSH agent socket for repo <%s>", repo.Name)
@@ -47,10 +226,11 @@ func CloneRepo(ctx *context.Context, cli *client.Client, repo Repository) (err e
 		log.Warningf("Cannot map SSH agent socket for repo <%s> because SSH_AUTH_SOCK is not set. Skipping.", repo.Name)
 	}
 
-	err = RunForegroundContainer(
+	_, err = RunForegroundContainer(
 		ctx,
 		cli,
 		"alpine/git",
+		"",
 		commands,
 		[]string{},
 		"",
@@ -60,40 +240,46 @@ func CloneRepo(ctx *context.Context, cli *client.Client, repo Repository) (err e
 		repo.VolumeName,
 		bindMounts,
 		false,
-		os.Stdout,
-		[]File{},
+		false,
+		stdoutWriter,
+		stderrWriter,
+		files,
 	)
 	if err != nil {
-		err = Error("Failed to clone repository <%s>: ", repo.Name, err)
+		err = Error("Failed to clone repository <%s>: %s", repo.Name, err)
 		return
 	}
 
 	if len(ref) > 0 {
-		err = RunForegroundContainer(
+		_, err = RunForegroundContainer(
 			ctx,
 			cli,
 			"alpine/git",
+			"",
 			[]string{"fetch", "--all"},
 			[]string{},
 			"",
-			[]string{},
+			environment,
 			repo.WorkingDirectory,
 			"",
 			repo.VolumeName,
 			bindMounts,
 			false,
-			os.Stdout,
-			[]File{},
+			false,
+			stdoutWriter,
+			stderrWriter,
+			files,
 		)
 		if err != nil {
 			err = Error("Failed to fetch from repository <%s>: %s", repo.Name, err)
 			return
 		}
 
-		err = RunForegroundContainer(
+		_, err = RunForegroundContainer(
 			ctx,
 			cli,
 			"alpine/git",
+			"",
 			[]string{"checkout", ref},
 			[]string{},
 			"",
@@ -103,7 +289,9 @@ func CloneRepo(ctx *context.Context, cli *client.Client, repo Repository) (err e
 			repo.VolumeName,
 			bindMounts,
 			false,
-			os.Stdout,
+			false,
+			stdoutWriter,
+			stderrWriter,
 			[]File{},
 		)
 		if err != nil {
@@ -114,3 +302,147 @@ func CloneRepo(ctx *context.Context, cli *client.Client, repo Repository) (err e
 
 	return
 }
+
+// RepoExists checks whether a repository has already been cloned into the volume, e.g. by importing a workspace
+func RepoExists(ctx *context.Context, cli *client.Client, repo Repository) (exists bool, err error) {
+	var directory string
+	directory, err = GetRepoDirectory(repo)
+	if err != nil {
+		return
+	}
+
+	stderrConsoleWriter := NewConsoleOutputWriter("stderr")
+	defer stderrConsoleWriter.Close()
+
+	var output bytes.Buffer
+	_, err = RunForegroundContainer(
+		ctx,
+		cli,
+		"alpine/git",
+		"",
+		[]string{"sh"},
+		[]string{
+			"if test -d '" + directory + "/.git'; then echo exists; fi",
+		},
+		"",
+		[]string{},
+		repo.WorkingDirectory,
+		"",
+		repo.VolumeName,
+		[]mount.Mount{},
+		true,
+		false,
+		&output,
+		stderrConsoleWriter,
+		[]File{},
+	)
+	if err != nil {
+		err = Error("Failed to check for repository <%s> in volume: %s", repo.Name, err)
+		return
+	}
+
+	exists = strings.TrimSpace(output.String()) == "exists"
+	return
+}
+
+// GetRepoMetadata resolves commit SHA, branch, tag and commit message of a repository in the volume
+func GetRepoMetadata(ctx *context.Context, cli *client.Client, repo Repository) (metadata RepositoryMetadata, err error) {
+	metadata.Name = repo.Name
+
+	var directory string
+	directory, err = GetRepoDirectory(repo)
+	if err != nil {
+		return
+	}
+
+	stderrConsoleWriter := NewConsoleOutputWriter("stderr")
+	defer stderrConsoleWriter.Close()
+
+	var output bytes.Buffer
+	_, err = RunForegroundContainer(
+		ctx,
+		cli,
+		"alpine/git",
+		"",
+		[]string{"sh"},
+		[]string{
+			"git config --global --add safe.directory '*'",
+			"cd '" + directory + "'",
+			"echo \"INSULATR_SHA=$(git rev-parse HEAD)\"",
+			"echo \"INSULATR_BRANCH=$(git symbolic-ref --quiet --short HEAD)\"",
+			"echo \"INSULATR_TAG=$(git describe --tags --exact-match 2>/dev/null)\"",
+			"echo \"INSULATR_MESSAGE=\"",
+			"git log -1 --format=%B",
+		},
+		"",
+		[]string{},
+		repo.WorkingDirectory,
+		"",
+		repo.VolumeName,
+		[]mount.Mount{},
+		true,
+		false,
+		&output,
+		stderrConsoleWriter,
+		[]File{},
+	)
+	if err != nil {
+		err = Error("Failed to read metadata of repository <%s>: %s", repo.Name, err)
+		return
+	}
+
+	// The commit message spans all lines after INSULATR_MESSAGE= because it may contain multiple lines
+	var message []string
+	inMessage := false
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		if inMessage {
+			message = append(message, scanner.Text())
+			continue
+		}
+		pair := strings.SplitN(scanner.Text(), "=", 2)
+		if len(pair) < 2 {
+			continue
+		}
+		switch pair[0] {
+		case "INSULATR_SHA":
+			metadata.SHA = pair[1]
+		case "INSULATR_BRANCH":
+			metadata.Branch = pair[1]
+		case "INSULATR_TAG":
+			metadata.Tag = pair[1]
+		case "INSULATR_MESSAGE":
+			inMessage = true
+		}
+	}
+	metadata.Message = strings.TrimRight(strings.Join(message, "\n"), "\n")
+	if len(metadata.SHA) == 0 {
+		err = Error("Failed to resolve commit of repository <%s>", repo.Name)
+		return
+	}
+
+	switch {
+	case len(metadata.Branch) > 0:
+		metadata.Ref = metadata.Branch
+	case len(metadata.Tag) > 0:
+		metadata.Ref = metadata.Tag
+	default:
+		metadata.Ref = metadata.SHA
+	}
+
+	return
+}
+
+var repoEnvironmentNameRegexp = regexp.MustCompile("[^A-Z0-9]+")
+
+// GetRepoEnvironment creates environment variables describing the resolved state of a repository
+func GetRepoEnvironment(metadata RepositoryMetadata) []string {
+	prefix := "INSULATR_REPO_" + repoEnvironmentNameRegexp.ReplaceAllString(strings.ToUpper(metadata.Name), "_") + "_"
+	return []string{
+		prefix + "SHA=" + metadata.SHA,
+		prefix + "REF=" + metadata.Ref,
+		prefix + "BRANCH=" + metadata.Branch,
+		prefix + "TAG=" + metadata.Tag,
+		prefix + "MESSAGE=" + metadata.Message,
+	}
+}
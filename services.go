@@ -1,15 +1,31 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
-	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-// StartService starts a single service in a container
-func StartService(ctx *context.Context, cli *client.Client, service Service, build *Build) (id string, err error) {
+// ServiceContainer describes the container running a service
+type ServiceContainer struct {
+	ID       string
+	LogsDone <-chan struct{}
+}
+
+// StartService starts a single service in a container and streams its logs to files
+func StartService(ctx *context.Context, cli *client.Client, service Service, build *Build) (serviceContainer ServiceContainer, err error) {
 	for index, envVarDef := range service.Environment {
 		if !strings.Contains(envVarDef, "=") {
 			foundMatch := false
@@ -27,41 +43,443 @@ func StartService(ctx *context.Context, cli *client.Client, service Service, bui
 		}
 	}
 
+	mounts := []mount.Mount{}
+	if service.MountVolume {
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: service.VolumeName,
+			Target: service.WorkingDirectory,
+		})
+	}
+
+	var id string
 	id, err = RunBackgroundContainer(
 		ctx,
 		cli,
 		service.Image,
+		service.Command,
+		service.Entrypoint,
 		service.Environment,
 		service.NetworkName,
-		service.Name,
+		append([]string{service.Name}, service.Aliases...),
+		service.ContainerName,
+		service.Labels,
 		service.Privileged,
+		service.Ports,
+		mounts,
+		service.Restart,
 	)
 	if err != nil {
 		err = Error("Failed to start service <%s>: %s", service.Name, err)
 		return
 	}
+	serviceContainer.ID = id
+
+	logsDone := make(chan struct{})
+	serviceContainer.LogsDone = logsDone
+	if service.SuppressLog {
+		close(logsDone)
+		return
+	}
+
+	var stdoutFile, stderrFile *os.File
+	stdoutFile, err = os.Create(filepath.Join(service.LogDirectory, GetLogFileName(service.Name)+".log"))
+	if err != nil {
+		err = Error("Failed to create log file for service <%s>: %s", service.Name, err)
+		close(logsDone)
+		return
+	}
+	stderrFile, err = os.Create(filepath.Join(service.LogDirectory, GetLogFileName(service.Name)+".stderr.log"))
+	if err != nil {
+		err = Error("Failed to create log file for service <%s>: %s", service.Name, err)
+		stdoutFile.Close()
+		close(logsDone)
+		return
+	}
+	// The logs are streamed beyond the lifetime of the caller so the context must not change underneath
+	streamCtx := *ctx
+	go func() {
+		defer close(logsDone)
+		defer stdoutFile.Close()
+		defer stderrFile.Close()
+
+		err := StreamContainerLogs(&streamCtx, cli, id, stdoutFile, stderrFile)
+		if err != nil {
+			log.Warningf("Failed to stream logs of service <%s>: %s", service.Name, err)
+		}
+	}()
 
 	return
 }
 
-// StopService stops a single service
-func StopService(ctx *context.Context, cli *client.Client, name string, id string, services []Service) (err error) {
-	var logWriter io.Writer
-	logWriter = os.Stdout
-	var service Service
-	for _, service = range services {
-		if service.Name == name {
-			break
+// CheckServiceDependencies makes sure that the dependencies between services do not contain cycles
+func CheckServiceDependencies(services []Service) (err error) {
+	dependencies := make(map[string][]string)
+	for _, service := range services {
+		dependencies[service.Name] = service.DependsOn
+	}
+
+	visiting := make(map[string]bool)
+	visited := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		path = append(path, name)
+		if visiting[name] {
+			return Error("Services depend on each other: %s", strings.Join(path, " -> "))
+		}
+		if visited[name] {
+			return nil
+		}
+		visiting[name] = true
+		for _, dependency := range dependencies[name] {
+			err := visit(dependency, path)
+			if err != nil {
+				return err
+			}
 		}
+		visiting[name] = false
+		visited[name] = true
+		return nil
 	}
-	if service.SuppressLog {
-		logWriter = nil
+
+	for _, service := range services {
+		err = visit(service.Name, []string{})
+		if err != nil {
+			return
+		}
 	}
-	err = StopAndRemoveContainer(ctx, cli, id, logWriter)
+
+	return
+}
+
+// StartServices pulls the images of all services concurrently and starts services as soon as their dependencies are ready
+func StartServices(ctx *context.Context, cli *client.Client, build *Build, containers map[string]ServiceContainer) (err error) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	done := make(map[string]chan struct{})
+	ready := make(map[string]bool)
+	for _, service := range build.Services {
+		done[service.Name] = make(chan struct{})
+	}
+
+	fail := func(serviceErr error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err == nil {
+			err = serviceErr
+		}
+	}
+
+	for _, service := range build.Services {
+		wg.Add(1)
+		go func(service Service) {
+			defer wg.Done()
+			succeeded := false
+			defer func() {
+				mutex.Lock()
+				ready[service.Name] = succeeded
+				mutex.Unlock()
+				close(done[service.Name])
+			}()
+
+			pullErr := PullImage(ctx, cli, service.Image, service.Pull)
+			if pullErr != nil {
+				fail(Error("Failed to pull image for service <%s>: %s", service.Name, pullErr))
+				return
+			}
+
+			for _, dependency := range service.DependsOn {
+				<-done[dependency]
+				mutex.Lock()
+				dependencyReady := ready[dependency]
+				mutex.Unlock()
+				if !dependencyReady {
+					log.Warningf("Not starting service <%s> because service <%s> failed", service.Name, dependency)
+					return
+				}
+			}
+
+			log.Noticef("########## Starting service <%s>", service.Name)
+
+			started := time.Now()
+			var serviceErr error
+			defer func() {
+				mutex.Lock()
+				build.Result.Record("service", service.Name, started, 0, serviceErr)
+				mutex.Unlock()
+			}()
+
+			serviceContainer, startErr := StartService(ctx, cli, service, build)
+			if len(serviceContainer.ID) > 0 {
+				mutex.Lock()
+				containers[service.Name] = serviceContainer
+				mutex.Unlock()
+			}
+			if startErr != nil {
+				serviceErr = startErr
+				fail(Error("Failed to start service <%s>: %s", service.Name, startErr))
+				return
+			}
+
+			if service.Healthcheck != nil {
+				log.Noticef("########## Waiting for service <%s>", service.Name)
+
+				waitErr := WaitForService(ctx, cli, service, serviceContainer.ID)
+				if waitErr != nil {
+					serviceErr = waitErr
+					fail(Error("Service <%s> did not become ready: %s", service.Name, waitErr))
+					return
+				}
+			}
+
+			succeeded = true
+		}(service)
+	}
+	wg.Wait()
+
+	return
+}
+
+// StopService stops a single service and waits for its logs to be written
+func StopService(ctx *context.Context, cli *client.Client, name string, serviceContainer ServiceContainer) (err error) {
+	err = StopAndRemoveContainer(ctx, cli, serviceContainer.ID)
 	if err != nil {
-		err = Error("Failed to stop service <%s> with ID <%s>: %s", name, id, err)
+		err = Error("Failed to stop service <%s> with ID <%s>: %s", name, serviceContainer.ID, err)
 		return
 	}
+	<-serviceContainer.LogsDone
+
+	return
+}
+
+// WaitForService waits until all configured healthchecks of a service succeed
+func WaitForService(ctx *context.Context, cli *client.Client, service Service, id string) (err error) {
+	healthcheck := service.Healthcheck
+	timeout := time.Duration(healthcheck.Timeout) * time.Second
+	interval := time.Duration(healthcheck.Interval) * time.Second
+
+	if healthcheck.TCP > 0 {
+		log.Infof("Waiting for port <%d> of service <%s>", healthcheck.TCP, service.Name)
+		err = ProbeService(ctx, cli, service, fmt.Sprintf("nc -z -w %d %s %d", healthcheck.Interval, service.Name, healthcheck.TCP))
+		if err != nil {
+			err = Error("Port <%d> did not open: %s", healthcheck.TCP, err)
+		}
+	}
+
+	if err == nil && len(healthcheck.HTTP) > 0 {
+		log.Infof("Waiting for <%s> of service <%s>", healthcheck.HTTP, service.Name)
+		err = ProbeService(ctx, cli, service, fmt.Sprintf("wget -q -O /dev/null -T %d '%s'", healthcheck.Interval, healthcheck.HTTP))
+		if err != nil {
+			err = Error("Request to <%s> did not succeed: %s", healthcheck.HTTP, err)
+		}
+	}
+
+	if err == nil && len(healthcheck.Command) > 0 {
+		log.Infof("Waiting for command <%s> in service <%s>", strings.Join(healthcheck.Command, " "), service.Name)
+		err = PollService(ctx, timeout, interval, func() (ready bool, err error) {
+			var exitCode int
+			exitCode, err = ExecInContainer(ctx, cli, id, healthcheck.Command)
+			return exitCode == 0, err
+		})
+		if err != nil {
+			err = Error("Command <%s> did not succeed: %s", strings.Join(healthcheck.Command, " "), err)
+		}
+	}
+
+	if err == nil && len(healthcheck.Log) > 0 {
+		log.Infof("Waiting for log line matching <%s> in service <%s>", healthcheck.Log, service.Name)
+		pattern := regexp.MustCompile(healthcheck.Log)
+		err = PollService(ctx, timeout, interval, func() (ready bool, err error) {
+			var logs bytes.Buffer
+			err = GetContainerLogs(ctx, cli, id, "all", &logs)
+			return pattern.Match(logs.Bytes()), err
+		})
+		if err != nil {
+			err = Error("No log line matched <%s>: %s", healthcheck.Log, err)
+		}
+	}
+
+	if err == nil && healthcheck.Docker {
+		log.Infof("Waiting for Docker healthcheck of service <%s>", service.Name)
+		err = PollService(ctx, timeout, interval, func() (ready bool, err error) {
+			var state *types.ContainerState
+			state, err = GetContainerState(ctx, cli, id)
+			if err != nil {
+				return
+			}
+			if state.Health == nil {
+				err = Error("Image <%s> does not define a healthcheck", service.Image)
+				return
+			}
+			return state.Health.Status == types.Healthy, nil
+		})
+		if err != nil {
+			err = Error("Docker healthcheck did not report healthy: %s", err)
+		}
+	}
+
+	if err != nil {
+		log.Errorf("Logs of service <%s>:", service.Name)
+		stdoutConsoleWriter := NewConsoleOutputWriter("stdout")
+		err2 := GetContainerLogs(ctx, cli, id, "all", stdoutConsoleWriter)
+		stdoutConsoleWriter.Close()
+		if err2 != nil {
+			log.Errorf("Failed to read logs of service <%s>: %s", service.Name, err2)
+		}
+	}
+
+	return
+}
+
+// PollService calls the check repeatedly until it reports success, fails or the timeout expires
+func PollService(ctx *context.Context, timeout time.Duration, interval time.Duration, check func() (bool, error)) (err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var ready bool
+		ready, err = check()
+		if err != nil || ready {
+			return
+		}
+		if time.Now().After(deadline) {
+			return Error("Timed out after %s", timeout)
+		}
+
+		select {
+		case <-(*ctx).Done():
+			return Error("Request timed out: %s", (*ctx).Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ProbeService repeatedly runs a command in a helper container on the build network until it succeeds or the timeout expires
+func ProbeService(ctx *context.Context, cli *client.Client, service Service, command string) (err error) {
+	stdoutConsoleWriter := NewConsoleOutputWriter("stdout")
+	defer stdoutConsoleWriter.Close()
+	stderrConsoleWriter := NewConsoleOutputWriter("stderr")
+	defer stderrConsoleWriter.Close()
+
+	_, err = RunForegroundContainer(
+		ctx,
+		cli,
+		"alpine",
+		"",
+		[]string{"sh"},
+		[]string{
+			fmt.Sprintf("end=$(( $(date +%%s) + %d ))", service.Healthcheck.Timeout),
+			fmt.Sprintf("until %s; do", command),
+			"  if test $(date +%s) -ge $end; then exit 1; fi",
+			fmt.Sprintf("  sleep %d", service.Healthcheck.Interval),
+			"done",
+		},
+		"",
+		[]string{},
+		"/",
+		service.NetworkName,
+		"",
+		[]mount.Mount{},
+		false,
+		false,
+		stdoutConsoleWriter,
+		stderrConsoleWriter,
+		[]File{},
+	)
+	if err != nil {
+		err = Error("Failed to probe service <%s>: %s", service.Name, err)
+		return
+	}
+
+	return
+}
+
+// WatchServices reports services exiting unexpectedly while build steps are running
+func WatchServices(ctx *context.Context, cli *client.Client, services map[string]ServiceContainer, definitions []Service, failures chan<- error, onFailure context.CancelFunc) (stop context.CancelFunc) {
+	watchCtx, stop := context.WithCancel(*ctx)
+
+	names := make(map[string]string)
+	restartPolicies := make(map[string]string)
+	eventFilters := filters.NewArgs()
+	eventFilters.Add("type", "container")
+	eventFilters.Add("event", "die")
+	for _, service := range definitions {
+		serviceContainer, exists := services[service.Name]
+		if !exists {
+			continue
+		}
+		id := serviceContainer.ID
+		names[id] = service.Name
+		restartPolicies[id] = service.Restart
+		eventFilters.Add("container", id)
+	}
+
+	// Without a container filter, the subscription would receive events for all containers on the host
+	if len(names) == 0 {
+		return stop
+	}
+
+	report := func(id string, exitCode string) {
+		name, isService := names[id]
+		if !isService {
+			return
+		}
+		switch restartPolicies[id] {
+		case "always", "unless-stopped":
+			log.Warningf("Service <%s> exited with code %s and will be restarted", name, exitCode)
+			return
+		case "on-failure":
+			if exitCode != "0" {
+				log.Warningf("Service <%s> exited with code %s and will be restarted", name, exitCode)
+				return
+			}
+		}
+
+		log.Errorf("Last log lines of service <%s>:", name)
+		stdoutConsoleWriter := NewConsoleOutputWriter("stdout")
+		err := GetContainerLogs(&watchCtx, cli, id, "20", stdoutConsoleWriter)
+		stdoutConsoleWriter.Close()
+		if err != nil {
+			log.Errorf("Failed to read logs of service <%s>: %s", name, err)
+		}
+
+		select {
+		case failures <- Error("Service <%s> exited unexpectedly with code %s", name, exitCode):
+			onFailure()
+		default:
+		}
+	}
+
+	messages, errs := cli.Events(watchCtx, types.EventsOptions{
+		Filters: eventFilters,
+	})
+
+	go func() {
+		for id, name := range names {
+			state, err := GetContainerState(&watchCtx, cli, id)
+			if err != nil {
+				log.Warningf("Unable to check state of service <%s>: %s", name, err)
+				continue
+			}
+			if !state.Running && !state.Restarting {
+				report(id, strconv.Itoa(state.ExitCode))
+			}
+		}
+
+		for {
+			select {
+			case <-watchCtx.Done():
+				return
+			case err := <-errs:
+				if err != nil && watchCtx.Err() == nil {
+					log.Warningf("Stopped watching services: %s", err)
+				}
+				return
+			case message := <-messages:
+				if message.Type == events.ContainerEventType && message.Action == "die" {
+					report(message.Actor.ID, message.Actor.Attributes["exitCode"])
+				}
+			}
+		}
+	}()
 
 	return
 }
@@ -4,12 +4,14 @@ import (
 	"context"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
-// RunStep executes a single step in a container
-func RunStep(ctx *context.Context, cli *client.Client, step Step, globalEnvironment []string) (err error) {
+// RunStep executes a single step in a container and returns the exit code
+func RunStep(ctx *context.Context, cli *client.Client, step Step, globalEnvironment []string) (exitCode int64, err error) {
 	environment := step.Environment
 	for _, globalEnvVar := range globalEnvironment {
 		environment = append(environment, globalEnvVar)
@@ -31,6 +33,10 @@ func RunStep(ctx *context.Context, cli *client.Client, step Step, globalEnvironm
 		}
 	}
 
+	if IsTracingEnabled() {
+		environment = append(environment, "TRACEPARENT="+GetTraceparent(*ctx))
+	}
+
 	bindMounts := []mount.Mount{}
 	if step.MountDockerSock {
 		log.Warning("Warning: Mounting Docker socket.")
@@ -54,10 +60,50 @@ func RunStep(ctx *context.Context, cli *client.Client, step Step, globalEnvironm
 		}
 	}
 
-	err = RunForegroundContainer(
+	var logFile *os.File
+	logFile, err = os.Create(filepath.Join(step.LogDirectory, GetLogFileName(step.Name)+".log"))
+	if err != nil {
+		err = Error("Failed to create log file for step <%s>: %s", step.Name, err)
+		return
+	}
+	defer logFile.Close()
+	stdoutLogWriter, stderrLogWriter := NewTaggedLineWriters(logFile)
+	defer stdoutLogWriter.Close()
+	defer stderrLogWriter.Close()
+
+	stdoutConsoleWriter := NewConsoleOutputWriter("stdout")
+	defer stdoutConsoleWriter.Close()
+	stderrConsoleWriter := NewConsoleOutputWriter("stderr")
+	defer stderrConsoleWriter.Close()
+
+	stdoutWriters := []io.Writer{stdoutConsoleWriter, stdoutLogWriter}
+	stderrWriters := []io.Writer{stderrConsoleWriter, stderrLogWriter}
+	if len(step.StdoutFile) > 0 {
+		var stdoutFile *os.File
+		stdoutFile, err = os.Create(step.StdoutFile)
+		if err != nil {
+			err = Error("Failed to create file <%s> for stdout of step <%s>: %s", step.StdoutFile, step.Name, err)
+			return
+		}
+		defer stdoutFile.Close()
+		stdoutWriters = append(stdoutWriters, stdoutFile)
+	}
+	if len(step.StderrFile) > 0 {
+		var stderrFile *os.File
+		stderrFile, err = os.Create(step.StderrFile)
+		if err != nil {
+			err = Error("Failed to create file <%s> for stderr of step <%s>: %s", step.StderrFile, step.Name, err)
+			return
+		}
+		defer stderrFile.Close()
+		stderrWriters = append(stderrWriters, stderrFile)
+	}
+
+	exitCode, err = RunForegroundContainer(
 		ctx,
 		cli,
 		step.Image,
+		step.Pull,
 		step.Shell,
 		step.Commands,
 		step.User,
@@ -67,7 +113,9 @@ func RunStep(ctx *context.Context, cli *client.Client, step Step, globalEnvironm
 		step.VolumeName,
 		bindMounts,
 		step.OverrideEntrypoint,
-		os.Stdout,
+		step.Timestamps,
+		io.MultiWriter(stdoutWriters...),
+		io.MultiWriter(stderrWriters...),
 		[]File{},
 	)
 	if err != nil {
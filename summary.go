@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SummaryRow describes a single part of the build in the summary table
+type SummaryRow struct {
+	Phase    string
+	Name     string
+	Status   string
+	Duration string
+	ExitCode string
+}
+
+// GetSummaryRows lists all parts of the build in the order they are executed
+func GetSummaryRows(build *Build) (rows []SummaryRow) {
+	expected := []SummaryRow{}
+	for _, image := range GetRequiredImages(build) {
+		expected = append(expected, SummaryRow{Phase: "image", Name: image.Image})
+	}
+	if !build.Settings.ReuseVolume {
+		expected = append(expected, SummaryRow{Phase: "volume", Name: build.Settings.VolumeName})
+	}
+	if !build.Settings.ReuseNetwork {
+		expected = append(expected, SummaryRow{Phase: "network", Name: build.Settings.NetworkName})
+	}
+	for _, repo := range build.Repositories {
+		expected = append(expected, SummaryRow{Phase: "repo", Name: repo.Name})
+	}
+	for _, service := range build.Services {
+		expected = append(expected, SummaryRow{Phase: "service", Name: service.Name})
+	}
+	if len(build.Files) > 0 {
+		expected = append(expected, SummaryRow{Phase: "inject", Name: "files"})
+	}
+	for _, step := range build.Steps {
+		expected = append(expected, SummaryRow{Phase: "step", Name: step.Name})
+	}
+	if len(build.Files) > 0 {
+		expected = append(expected, SummaryRow{Phase: "extract", Name: "files"})
+	}
+
+	for _, row := range expected {
+		row.Status = "skipped"
+		row.Duration = "-"
+		row.ExitCode = "-"
+
+		phase, found := build.Result.GetPhase(row.Phase, row.Name)
+		if found {
+			row.Status = "success"
+			if !phase.Success {
+				row.Status = "failed"
+			}
+			row.Duration = phase.Duration.Round(time.Millisecond).String()
+			if row.Phase == "step" {
+				row.ExitCode = strconv.FormatInt(phase.ExitCode, 10)
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return
+}
+
+// LogBuildSummary displays a table with the outcome of all parts of the build
+func LogBuildSummary(build *Build) {
+	rows := GetSummaryRows(build)
+	if len(rows) == 0 {
+		return
+	}
+
+	header := SummaryRow{Phase: "PHASE", Name: "NAME", Status: "STATUS", Duration: "DURATION", ExitCode: "EXIT CODE"}
+	widths := []int{0, 0, 0, 0}
+	for _, row := range append([]SummaryRow{header}, rows...) {
+		for index, value := range []string{row.Phase, row.Name, row.Status, row.Duration} {
+			if len(value) > widths[index] {
+				widths[index] = len(value)
+			}
+		}
+	}
+
+	log.Notice("########## Summary")
+	for _, row := range append([]SummaryRow{header}, rows...) {
+		line := fmt.Sprintf("%-*s  %-*s  %-*s  %-*s  %s", widths[0], row.Phase, widths[1], row.Name, widths[2], row.Status, widths[3], row.Duration, row.ExitCode)
+		if row.Status == "failed" {
+			log.Error(line)
+		} else {
+			log.Notice(line)
+		}
+	}
+}
+
+// WriteBuildSummary writes summary.md containing the summary table in Markdown format
+func WriteBuildSummary(build *Build) (err error) {
+	var summary strings.Builder
+	summary.WriteString("# Build " + build.Settings.BuildID + "\n\n")
+	summary.WriteString("| Phase | Name | Status | Duration | Exit code |\n")
+	summary.WriteString("|-------|------|--------|----------|-----------|\n")
+	for _, row := range GetSummaryRows(build) {
+		name := strings.Replace(row.Name, "|", "\\|", -1)
+		summary.WriteString(fmt.Sprintf("| %s | %s | %s | %s | %s |\n", row.Phase, name, row.Status, row.Duration, row.ExitCode))
+	}
+
+	path := filepath.Join(GetBuildLogDirectory(build.Settings), "summary.md")
+	err = ioutil.WriteFile(path, []byte(summary.String()), 0644)
+	if err != nil {
+		return Error("Failed to write build summary to <%s>: %s", path, err)
+	}
+
+	return
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span describes a single timed operation of the build
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Error        string
+}
+
+type spanContextKey struct{}
+
+// tracer collects all finished spans
+var tracer = struct {
+	sync.Mutex
+	enabled bool
+	spans   []*Span
+}{}
+
+// EnableTracing starts collecting spans
+func EnableTracing() {
+	tracer.Lock()
+	defer tracer.Unlock()
+	tracer.enabled = true
+}
+
+// IsTracingEnabled checks whether spans are collected
+func IsTracingEnabled() bool {
+	tracer.Lock()
+	defer tracer.Unlock()
+	return tracer.enabled
+}
+
+func newTraceID(length int) string {
+	id := make([]byte, length)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// ParseTraceparent extracts trace ID and span ID from the value of TRACEPARENT
+func ParseTraceparent(traceparent string) (traceID string, spanID string, ok bool) {
+	fields := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(fields) < 4 || len(fields[1]) != 32 || len(fields[2]) != 16 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(fields[1] + fields[2]); err != nil {
+		return "", "", false
+	}
+	return fields[1], fields[2], true
+}
+
+// StartSpan creates a span as a child of the span contained in the context
+func StartSpan(ctx context.Context, name string, attributes ...string) (context.Context, *Span) {
+	span := &Span{
+		SpanID:     newTraceID(8),
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+	}
+	for index := 0; index+1 < len(attributes); index += 2 {
+		span.Attributes[attributes[index]] = attributes[index+1]
+	}
+
+	if parent, ok := ctx.Value(spanContextKey{}).(*Span); ok {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	} else {
+		span.TraceID = newTraceID(16)
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// StartRemoteSpan creates a span as a child of the span described by TRACEPARENT
+func StartRemoteSpan(ctx context.Context, traceparent string, name string, attributes ...string) (context.Context, *Span) {
+	traceID, spanID, ok := ParseTraceparent(traceparent)
+	if ok {
+		ctx = context.WithValue(ctx, spanContextKey{}, &Span{TraceID: traceID, SpanID: spanID})
+	}
+	return StartSpan(ctx, name, attributes...)
+}
+
+// Finish records the end and the outcome of the span
+func (span *Span) Finish(err error) {
+	span.End = time.Now()
+	if err != nil {
+		span.Error = err.Error()
+	}
+
+	tracer.Lock()
+	defer tracer.Unlock()
+	if tracer.enabled {
+		tracer.spans = append(tracer.spans, span)
+	}
+}
+
+// GetTraceparent returns the value for TRACEPARENT describing the span contained in the context
+func GetTraceparent(ctx context.Context) string {
+	span, ok := ctx.Value(spanContextKey{}).(*Span)
+	if !ok {
+		return ""
+	}
+	return "00-" + span.TraceID + "-" + span.SpanID + "-01"
+}
+
+// OTLPExport is used to export spans in OTLP/JSON format
+type OTLPExport struct {
+	ResourceSpans []OTLPResourceSpans `json:"resourceSpans"`
+}
+
+// OTLPResourceSpans is used to export spans in OTLP/JSON format
+type OTLPResourceSpans struct {
+	Resource   OTLPResource     `json:"resource"`
+	ScopeSpans []OTLPScopeSpans `json:"scopeSpans"`
+}
+
+// OTLPResource is used to export spans in OTLP/JSON format
+type OTLPResource struct {
+	Attributes []OTLPAttribute `json:"attributes"`
+}
+
+// OTLPScopeSpans is used to export spans in OTLP/JSON format
+type OTLPScopeSpans struct {
+	Scope OTLPScope  `json:"scope"`
+	Spans []OTLPSpan `json:"spans"`
+}
+
+// OTLPScope is used to export spans in OTLP/JSON format
+type OTLPScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// OTLPSpan is used to export spans in OTLP/JSON format
+type OTLPSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []OTLPAttribute `json:"attributes"`
+	Status            OTLPStatus      `json:"status"`
+}
+
+// OTLPAttribute is used to export spans in OTLP/JSON format
+type OTLPAttribute struct {
+	Key   string             `json:"key"`
+	Value OTLPAttributeValue `json:"value"`
+}
+
+// OTLPAttributeValue is used to export spans in OTLP/JSON format
+type OTLPAttributeValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// OTLPStatus is used to export spans in OTLP/JSON format
+type OTLPStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// GetTraces converts all finished spans to OTLP/JSON
+func GetTraces() (data []byte, err error) {
+	tracer.Lock()
+	spans := append([]*Span{}, tracer.spans...)
+	tracer.Unlock()
+
+	scopeSpans := OTLPScopeSpans{
+		Scope: OTLPScope{
+			Name:    "insulatr",
+			Version: Version,
+		},
+		Spans: []OTLPSpan{},
+	}
+	for _, span := range spans {
+		otlpSpan := OTLPSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentSpanID,
+			Name:              span.Name,
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        []OTLPAttribute{},
+			Status: OTLPStatus{
+				Code: 1,
+			},
+		}
+		for key, value := range span.Attributes {
+			otlpSpan.Attributes = append(otlpSpan.Attributes, OTLPAttribute{
+				Key:   key,
+				Value: OTLPAttributeValue{StringValue: value},
+			})
+		}
+		if len(span.Error) > 0 {
+			otlpSpan.Status = OTLPStatus{
+				Code:    2,
+				Message: span.Error,
+			}
+		}
+		scopeSpans.Spans = append(scopeSpans.Spans, otlpSpan)
+	}
+
+	return json.Marshal(OTLPExport{
+		ResourceSpans: []OTLPResourceSpans{
+			{
+				Resource: OTLPResource{
+					Attributes: []OTLPAttribute{
+						{
+							Key:   "service.name",
+							Value: OTLPAttributeValue{StringValue: "insulatr"},
+						},
+					},
+				},
+				ScopeSpans: []OTLPScopeSpans{scopeSpans},
+			},
+		},
+	})
+}
+
+// WriteTraceFile writes all finished spans to a file in OTLP/JSON format
+func WriteTraceFile(path string) (err error) {
+	var data []byte
+	data, err = GetTraces()
+	if err != nil {
+		return Error("Failed to serialize traces: %s", err)
+	}
+	err = ioutil.WriteFile(path, append(data, '\n'), 0644)
+	if err != nil {
+		return Error("Failed to write traces to <%s>: %s", path, err)
+	}
+
+	return
+}
+
+// SendTraces sends all finished spans to an OTLP/HTTP endpoint
+func SendTraces(endpoint string) (err error) {
+	var data []byte
+	data, err = GetTraces()
+	if err != nil {
+		return Error("Failed to serialize traces: %s", err)
+	}
+
+	url := strings.TrimRight(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url = url + "/v1/traces"
+	}
+	client := http.Client{
+		Timeout: 30 * time.Second,
+	}
+	var response *http.Response
+	response, err = client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return Error("Failed to send traces to <%s>: %s", url, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return Error("Failed to send traces to <%s>: %s", url, response.Status)
+	}
+
+	return
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	dockernetwork "github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"io"
+	"os"
+)
+
+// CreateWorkspaceContainer creates a container with the volume mounted to copy files from and to the volume
+func CreateWorkspaceContainer(ctx *context.Context, cli *client.Client, volumeName string, dir string) (id string, err error) {
+	err = PullImage(ctx, cli, "alpine", "")
+	if err != nil {
+		return
+	}
+
+	resp, err := cli.ContainerCreate(
+		*ctx,
+		&container.Config{
+			Image:      "alpine",
+			WorkingDir: dir,
+		},
+		&container.HostConfig{
+			Mounts: []mount.Mount{
+				{
+					Type:   mount.TypeVolume,
+					Source: volumeName,
+					Target: dir,
+				},
+			},
+		},
+		&dockernetwork.NetworkingConfig{},
+		"",
+	)
+	if err != nil {
+		err = Error("Failed to create container: %s", err)
+		return
+	}
+
+	return resp.ID, nil
+}
+
+// RemoveWorkspaceContainer removes the container used to copy files from and to the volume
+func RemoveWorkspaceContainer(ctx *context.Context, cli *client.Client, id string) (err error) {
+	err = cli.ContainerRemove(*ctx, id, types.ContainerRemoveOptions{
+		Force: true,
+	})
+	if err != nil {
+		err = Error("Failed to remove container: %s", err)
+	}
+
+	return
+}
+
+// ExportWorkspace writes the contents of the volume to a compressed tarball
+func ExportWorkspace(ctx *context.Context, cli *client.Client, volumeName string, dir string, path string) (err error) {
+	_, err = cli.VolumeInspect(*ctx, volumeName)
+	if err != nil {
+		return Error("Failed to find volume <%s>: %s", volumeName, err)
+	}
+
+	var id string
+	id, err = CreateWorkspaceContainer(ctx, cli, volumeName, dir)
+	if err != nil {
+		return
+	}
+	defer RemoveWorkspaceContainer(ctx, cli, id)
+
+	var content io.ReadCloser
+	content, _, err = cli.CopyFromContainer(*ctx, id, dir+"/.")
+	if err != nil {
+		return Error("Failed to copy from volume <%s>: %s", volumeName, err)
+	}
+	defer content.Close()
+
+	var file *os.File
+	file, err = os.Create(path)
+	if err != nil {
+		return Error("Failed to create file <%s>: %s", path, err)
+	}
+	defer file.Close()
+
+	writer := gzip.NewWriter(file)
+	_, err = io.Copy(writer, content)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return Error("Failed to write workspace to <%s>: %s", path, err)
+	}
+
+	return
+}
+
+// ImportWorkspace extracts a compressed tarball into the volume and creates the volume if necessary
+func ImportWorkspace(ctx *context.Context, cli *client.Client, volumeName string, volumeDriver string, volumeDriverOpts map[string]string, volumeLabels map[string]string, dir string, path string) (err error) {
+	var file *os.File
+	file, err = os.Open(path)
+	if err != nil {
+		return Error("Failed to open file <%s>: %s", path, err)
+	}
+	defer file.Close()
+
+	var reader *gzip.Reader
+	reader, err = gzip.NewReader(file)
+	if err != nil {
+		return Error("Failed to decompress file <%s>: %s", path, err)
+	}
+	defer reader.Close()
+
+	_, err = cli.VolumeInspect(*ctx, volumeName)
+	if err != nil {
+		if !client.IsErrNotFound(err) {
+			return Error("Failed to inspect volume <%s>: %s", volumeName, err)
+		}
+
+		err = CreateVolume(ctx, cli, volumeName, volumeDriver, volumeDriverOpts, volumeLabels)
+		if err != nil {
+			return
+		}
+	}
+
+	var id string
+	id, err = CreateWorkspaceContainer(ctx, cli, volumeName, dir)
+	if err != nil {
+		return
+	}
+	defer RemoveWorkspaceContainer(ctx, cli, id)
+
+	err = cli.CopyToContainer(*ctx, id, dir, reader, types.CopyToContainerOptions{
+		AllowOverwriteDirWithFile: false,
+	})
+	if err != nil {
+		return Error("Failed to copy to volume <%s>: %s", volumeName, err)
+	}
+
+	return
+}